@@ -2,18 +2,37 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"network-pong-battle/internal/game"
 	"network-pong-battle/internal/net"
 	"network-pong-battle/internal/ui"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 )
 
 func main() {
 	// Parse command line flags
-	serverAddr := flag.String("server", "localhost:8080", "Server address to connect to")
+	serverAddr := flag.String("server", "localhost:8080", "Server address to connect to: host:port, or a URL such as tcp://[::1]:9000 or unix:///tmp/pong.sock")
 	playerName := flag.String("name", "Player", "Player name")
+	roomID := flag.String("room", "", "Room to join (default: any room with a free seat)")
+	joinCode := flag.String("code", "", "Join code of the room to join, for private rooms")
+	password := flag.String("password", "", "Password of the room to join, or to set on a created room")
+	createRoom := flag.String("create", "", "Create a room with this name instead of joining one")
+	private := flag.Bool("private", false, "Keep a created room out of room lists; others join it by code")
+	ballCount := flag.Int("balls", 0, "Ball count for a created room (0 for server default)")
+	targetScore := flag.Int("target", 0, "Target score for a created room (0 for server default)")
+	timeLimit := flag.Duration("time-limit", 0, "Time limit for a created room (0 for server default)")
+	listRooms := flag.Bool("list", false, "List the server's rooms and exit")
+	spectate := flag.Bool("spectate", false, "Watch a room instead of playing (default: any public game)")
+	jsonOnly := flag.Bool("json", false, "Keep every message in JSON instead of binary frames, for debugging")
+	useUDP := flag.Bool("udp", false, "Send snapshots and inputs over UDP if the server allows it")
+	idleTimeout := flag.Duration("idle-timeout", net.DefaultIdleTimeout, "Drop the connection and reconnect when nothing is heard from the server for this long (0 disables)")
+	maxMessageSize := flag.Int("max-message-size", net.DefaultMaxMessageSize, "Drop the connection if the server sends a message larger than this many bytes")
+	useTLS := flag.Bool("tls", false, "Connect over TLS, checking the server's certificate against the system's CAs")
+	caFile := flag.String("ca", "", "Check the server's certificate against the CA in this PEM file instead (implies -tls)")
+	fingerprint := flag.String("fingerprint", "", "Accept only a server certificate with this SHA-256 fingerprint, with no CA needed (implies -tls)")
 	flag.Parse()
 
 	log.Println("Starting Network Pong Battle Client...")
@@ -21,6 +40,24 @@ func main() {
 
 	// Create network client
 	client := net.NewClient(*serverAddr, *playerName)
+	if *spectate {
+		client.SetRole(net.RoleSpectator)
+	}
+	if *jsonOnly {
+		client.SetBinaryEncoding(false)
+	}
+	if *useUDP {
+		client.SetUDP(true)
+	}
+	client.SetMaxMessageSize(*maxMessageSize)
+	client.SetIdleTimeout(*idleTimeout)
+	if *useTLS || *caFile != "" || *fingerprint != "" {
+		tlsConfig, err := net.ClientTLSConfig(*caFile, *fingerprint)
+		if err != nil {
+			log.Fatalf("Invalid TLS settings: %v", err)
+		}
+		client.SetTLS(tlsConfig)
+	}
 
 	// Create renderer
 	renderer := ui.NewRenderer(600)
@@ -31,11 +68,9 @@ func main() {
 
 	// Set up callbacks
 	client.SetCallbacks(
-		// onStateUpdate
-		func(state game.GameState) {
-
-			renderer.SetGameState(&state)
-		},
+		// onStateUpdate is not needed for drawing: Update samples the
+		// client's interpolation buffer every frame instead
+		nil,
 		// onGameStart
 		func(settings game.GameSettings) {
 			log.Println("Game started - You can now move your paddles!")
@@ -43,22 +78,57 @@ func main() {
 			renderer.SetShowMenu(false)
 		},
 		// onGameEnd
-		func(winner int, scores game.Scores, gameTime int64) {
+		func(winner int, scores game.Scores, gameTime int64, reason string) {
+			renderer.SetEndReason(reason)
 			renderer.SetGameOver(true, winner)
 		},
 		// onJoin
 		func(playerID int, playerName string) {
 			renderer.SetPlayerID(playerID)
+			renderer.SetSpectator(client.IsSpectator())
 			renderer.SetShowMenu(false)
 			// Don't set gameStarted yet - wait for start message
 		},
 	)
 
+	client.SetPauseCallback(func(paused bool, playerID int, grace time.Duration) {
+		renderer.SetPaused(paused, playerID)
+	})
+	client.SetRosterCallback(renderer.SetRoster)
+	client.SetRoomCreatedCallback(func(roomID, name, code string) {
+		fmt.Printf("Created room %q. Others can join with -code %s\n", name, code)
+	})
+	client.SetErrorCallback(func(err *net.ServerError) {
+		renderer.SetError(err.Message, err.Fatal)
+	})
+
 	// Connect to server
 	if err := client.Connect(); err != nil {
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
 
+	if *listRooms {
+		printRooms(client)
+		return
+	}
+
+	// Take a seat in a room
+	var err error
+	if *spectate {
+		err = client.Spectate(*roomID, *joinCode, *password)
+	} else if *createRoom != "" {
+		err = client.CreateRoom(*createRoom, *private, *password, net.RoomSettings{
+			BallCount:   *ballCount,
+			TargetScore: *targetScore,
+			TimeLimit:   int(timeLimit.Seconds()),
+		})
+	} else {
+		err = client.JoinRoom(*roomID, *joinCode, *password)
+	}
+	if err != nil {
+		log.Fatalf("Failed to join a room: %v", err)
+	}
+
 	// Set client in input handler
 	inputHandler.SetClient(client)
 
@@ -74,12 +144,48 @@ func main() {
 		client:       client,
 	}
 
-	// Run the game
-	if err := ebiten.RunGame(game); err != nil {
+	// Run the game, and hang up once the window closes
+	err = ebiten.RunGame(game)
+	client.Disconnect()
+	if err != nil {
 		log.Fatalf("Game error: %v", err)
 	}
 }
 
+// printRooms prints the server's rooms and disconnects
+func printRooms(client *net.GameClient) {
+	rooms := make(chan []net.RoomInfo, 1)
+	client.SetRoomListCallback(func(list []net.RoomInfo) {
+		rooms <- list
+	})
+	if err := client.ListRooms(); err != nil {
+		log.Fatalf("Failed to list rooms: %v", err)
+	}
+	defer client.Disconnect()
+
+	select {
+	case list := <-rooms:
+		if len(list) == 0 {
+			fmt.Println("No rooms yet. Join without -room to create one.")
+		}
+		for _, room := range list {
+			status := "waiting"
+			if room.Started {
+				status = "playing"
+			}
+			if room.Locked {
+				status += ", password"
+			}
+			if room.Spectators > 0 {
+				status += fmt.Sprintf(", %d watching", room.Spectators)
+			}
+			fmt.Printf("%-6s %-32s %d/%d  %s\n", room.ID, room.Name, room.Players, room.MaxPlayers, status)
+		}
+	case <-time.After(5 * time.Second):
+		log.Fatal("Timed out waiting for the room list")
+	}
+}
+
 // Game implements ebiten.Game interface
 type Game struct {
 	renderer     *ui.Renderer
@@ -90,6 +196,10 @@ type Game struct {
 // Update updates the game state
 func (g *Game) Update() error {
 	g.inputHandler.Update()
+	if state, ok := g.client.GetInterpolatedState(time.Now()); ok {
+		g.renderer.SetGameState(&state)
+	}
+	g.renderer.SetPredictedPaddles(g.client.GetPredictedPaddles())
 	return nil
 }
 
@@ -1,40 +1,113 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"network-pong-battle/internal/game"
 	"network-pong-battle/internal/net"
 )
 
 func main() {
 	// Parse command line flags
 	port := flag.String("port", "8080", "Port to listen on")
+	listenAddr := flag.String("listen", "", "Address to listen on instead of -port: host:port, or a URL such as tcp://[::1]:9000, tcp6://[::]:9000 or unix:///tmp/pong.sock")
+	wsPort := flag.String("ws-port", "", "Port to take WebSocket connections from browsers on (empty disables WebSocket)")
+	wsOrigins := flag.String("ws-origins", "", "Comma-separated origins whose pages may connect over WebSocket, such as https://pong.example.com (* allows any)")
+	udpPort := flag.String("udp-port", "", "UDP port for clients that want snapshots and inputs over UDP (empty disables UDP)")
+	botOnDisconnect := flag.Bool("bot-on-disconnect", false, "Let a bot take over a disconnected player's paddles")
+	botIdleTimeout := flag.Duration("bot-idle-timeout", 0, "Let a bot take over after this long without input (0 disables)")
+	queueSize := flag.Int("queue-size", net.DefaultQueueSize, "Outbound messages buffered per client")
+	queuePolicy := flag.String("queue-policy", "drop", "What to do when a client's queue is full: drop (stale state) or disconnect")
+	maxRooms := flag.Int("max-rooms", 32, "Maximum number of rooms at once (0 for no limit)")
+	maxSpectators := flag.Int("max-spectators", 16, "Maximum number of spectators per room (0 for no limit)")
+	spectatorDelay := flag.Duration("spectator-delay", 0, "Delay everything spectators see by this long")
+	tickRate := flag.Int("tick-rate", game.BaseTickRate, "Times per second each room simulates its game")
+	sendRate := flag.Int("send-rate", game.BaseTickRate, "Snapshots per second each room sends, at most -tick-rate (clients that cannot keep up get fewer)")
+	keyframeInterval := flag.Duration("keyframe-interval", time.Second, "How often players getting delta snapshots are sent a full one (0 sends every snapshot full)")
+	abandonPolicy := flag.String("abandon-policy", "forfeit", "How a game ends when a player leaves for good: forfeit (the other player wins) or abandon (no winner)")
+	reconnectGrace := flag.Duration("reconnect-grace", 30*time.Second, "How long a disconnected player's seat is held, with the game paused (0 to free it at once)")
+	writeTimeout := flag.Duration("write-timeout", 2*time.Second, "Disconnect a client when a write blocks this long")
+	idleTimeout := flag.Duration("idle-timeout", net.DefaultIdleTimeout, "Disconnect a client nothing has been heard from for this long (0 disables)")
+	maxMessageSize := flag.Int("max-message-size", net.DefaultMaxMessageSize, "Disconnect a client that sends a message larger than this many bytes")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file to encrypt TCP and WebSocket connections with (needs -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Generate a self-signed -tls-cert and -tls-key if neither exists yet")
 	flag.Parse()
 
+	if *queueSize <= 0 {
+		log.Fatalf("Invalid -queue-size: %d, a client needs room for at least one message", *queueSize)
+	}
+
+	policy, err := net.ParseQueuePolicy(*queuePolicy)
+	if err != nil {
+		log.Fatalf("Invalid -queue-policy: %v", err)
+	}
+
+	abandon, err := net.ParseAbandonPolicy(*abandonPolicy)
+	if err != nil {
+		log.Fatalf("Invalid -abandon-policy: %v", err)
+	}
+
 	log.Println("Starting Network Pong Battle Server...")
-	log.Printf("Server will listen on port %s", *port)
+	addr := *port
+	if *listenAddr != "" {
+		addr = *listenAddr
+	}
+	log.Printf("Server will listen on %s", addr)
 
 	// Create and start server
-	server := net.NewServer(*port)
-	
-	if err := server.Start(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	config := net.DefaultServerConfig()
+	config.BotOnDisconnect = *botOnDisconnect
+	config.BotIdleTimeout = *botIdleTimeout
+	config.QueueSize = *queueSize
+	config.QueuePolicy = policy
+	config.WriteTimeout = *writeTimeout
+	config.IdleTimeout = *idleTimeout
+	config.MaxMessageSize = *maxMessageSize
+	config.MaxRooms = *maxRooms
+	config.MaxSpectators = *maxSpectators
+	config.SpectatorDelay = *spectatorDelay
+	config.TickRate = *tickRate
+	config.SendRate = *sendRate
+	config.KeyframeInterval = *keyframeInterval
+	config.UDPPort = *udpPort
+	config.WSPort = *wsPort
+	if *wsOrigins != "" {
+		for _, origin := range strings.Split(*wsOrigins, ",") {
+			config.AllowedOrigins = append(config.AllowedOrigins, strings.TrimSpace(origin))
+		}
+	}
+	config.ReconnectGrace = *reconnectGrace
+	config.AbandonPolicy = abandon
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatalf("-tls-cert and -tls-key must be given together")
+		}
+		config.TLS, err = net.ServerTLSConfig(*tlsCert, *tlsKey, *tlsSelfSigned)
+		if err != nil {
+			log.Fatalf("Invalid TLS settings: %v", err)
+		}
+		log.Printf("Using TLS, certificate fingerprint %s", net.Fingerprint(config.TLS))
+	} else if *tlsSelfSigned {
+		log.Fatalf("-tls-self-signed needs -tls-cert and -tls-key to say where to keep them")
 	}
+	server := net.NewServerWithConfig(addr, config)
+
+	// Run until interrupted, then tell clients we are going and let their
+	// connections drain before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Wait for interrupt signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	
 	log.Println("Server is running. Press Ctrl+C to stop.")
-	
-	// Wait for signal
-	<-sigChan
-	
-	log.Println("Shutting down server...")
-	server.Stop()
+	if err := server.Run(ctx); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
 	log.Println("Server stopped.")
 }
@@ -28,10 +28,11 @@ func NewBall(x, y, speed float64) Ball {
 	}
 }
 
-// Update moves the ball based on its current velocity
-func (b *Ball) Update(fieldSize int) {
-	b.X += b.DX
-	b.Y += b.DY
+// Update moves the ball based on its current velocity, over step ticks
+// at BaseTickRate
+func (b *Ball) Update(fieldSize int, step float64) {
+	b.X += b.DX * step
+	b.Y += b.DY * step
 }
 
 // CheckWallCollision checks and handles wall collisions
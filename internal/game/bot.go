@@ -0,0 +1,78 @@
+package game
+
+import "math"
+
+// Bot controls a player's paddles when no human is doing so
+type Bot struct {
+	PlayerID int
+}
+
+// NewBot creates a bot for the given player
+func NewBot(playerID int) *Bot {
+	return &Bot{PlayerID: playerID}
+}
+
+// NextInput returns the input that moves each of the bot's paddles one step
+// towards the ball that will reach its edge first
+func (b *Bot) NextInput(paddles []Paddle, balls []Ball, fieldSize int) Input {
+	var input Input
+	for i := range paddles {
+		paddle := &paddles[i]
+		if paddle.PlayerID != b.PlayerID {
+			continue
+		}
+
+		centerX, centerY := paddle.GetCenter()
+		target := b.targetFor(paddle, balls, fieldSize)
+		switch paddle.PaddleID {
+		case 1: // Vertical paddle
+			input.Vertical = b.step(centerY, target, paddle.Speed)
+		case 2: // Horizontal paddle
+			input.Horizontal = b.step(centerX, target, paddle.Speed)
+		}
+	}
+	return input
+}
+
+// targetFor returns the coordinate along the paddle's axis that it should
+// move to. With no ball approaching its edge the paddle returns to centre.
+func (b *Bot) targetFor(paddle *Paddle, balls []Ball, fieldSize int) float64 {
+	field := float64(fieldSize)
+	target := field / 2
+	soonest := math.Inf(1)
+
+	for _, ball := range balls {
+		var eta, position float64
+		switch {
+		case paddle.PaddleID == 1 && b.PlayerID == 1 && ball.DX < 0: // Left edge
+			eta, position = ball.X/-ball.DX, ball.Y
+		case paddle.PaddleID == 1 && b.PlayerID == 2 && ball.DX > 0: // Right edge
+			eta, position = (field-ball.X)/ball.DX, ball.Y
+		case paddle.PaddleID == 2 && b.PlayerID == 1 && ball.DY < 0: // Top edge
+			eta, position = ball.Y/-ball.DY, ball.X
+		case paddle.PaddleID == 2 && b.PlayerID == 2 && ball.DY > 0: // Bottom edge
+			eta, position = (field-ball.Y)/ball.DY, ball.X
+		default:
+			continue
+		}
+
+		if eta < soonest {
+			soonest = eta
+			target = position
+		}
+	}
+
+	return target
+}
+
+// step returns the direction (-1, 0 or 1) that moves current towards target,
+// staying still once within one step to avoid jittering around it
+func (b *Bot) step(current, target, speed float64) float64 {
+	if math.Abs(target-current) <= speed {
+		return 0
+	}
+	if target < current {
+		return -1
+	}
+	return 1
+}
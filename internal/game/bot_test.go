@@ -0,0 +1,75 @@
+package game
+
+import (
+	"math"
+	"testing"
+)
+
+// TestBotTracksBall checks which way the bot steers each of its paddles
+// for balls coming at its edges, going away from them, or none at all
+func TestBotTracksBall(t *testing.T) {
+	const fieldSize = 800
+	// Both of player 1's paddles are centred, at 400 along their axis
+	paddles := []Paddle{
+		NewPaddle(1, 1, 0, 350, 10, 100),
+		NewPaddle(1, 2, 350, 0, 100, 10),
+		NewPaddle(2, 1, 790, 0, 10, 100),
+	}
+	ball := func(x, y, dx, dy float64) Ball { return Ball{X: x, Y: y, DX: dx, DY: dy, Radius: 5} }
+
+	for _, tc := range []struct {
+		name  string
+		balls []Ball
+		want  Input
+	}{
+		{"no balls", nil, Input{}},
+		{"towards the left edge below", []Ball{ball(400, 600, -3, 0)}, Input{Vertical: 1}},
+		{"towards the top edge to the left", []Ball{ball(100, 400, 0, -3)}, Input{Horizontal: -1}},
+		{"away from both edges", []Ball{ball(100, 100, 3, 3)}, Input{}},
+		{"within a step", []Ball{ball(400, 403, -3, -3)}, Input{}},
+		{"soonest ball wins", []Ball{ball(700, 100, -3, 0), ball(100, 700, -3, 0)}, Input{Vertical: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewBot(1).NextInput(paddles, tc.balls, fieldSize); got != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestBotPaddleLimits plays a bot's paddles against a ball heading for a
+// corner and checks that they never move faster than their speed or leave
+// the field, and end up where the ball arrives
+func TestBotPaddleLimits(t *testing.T) {
+	const fieldSize = 800
+	paddles := []Paddle{
+		NewPaddle(2, 1, 790, 350, 10, 100),
+		NewPaddle(2, 2, 350, 790, 100, 10),
+	}
+	ball := Ball{X: 400, Y: 400, DX: 2, DY: 2, Radius: 5}
+	bot := NewBot(2)
+
+	for tick := 0; tick < 195; tick++ {
+		input := bot.NextInput(paddles, []Ball{ball}, fieldSize)
+		for i := range paddles {
+			before := paddles[i]
+			paddles[i].Move(input.Horizontal, input.Vertical, fieldSize)
+			moved := math.Hypot(paddles[i].X-before.X, paddles[i].Y-before.Y)
+			if moved > paddles[i].Speed {
+				t.Fatalf("tick %d: paddle %d moved %v, faster than its speed %v", tick, i+1, moved, paddles[i].Speed)
+			}
+			if paddles[i].X < 0 || paddles[i].X > fieldSize-paddles[i].Width ||
+				paddles[i].Y < 0 || paddles[i].Y > fieldSize-paddles[i].Height {
+				t.Fatalf("tick %d: paddle %d left the field at %v, %v", tick, i+1, paddles[i].X, paddles[i].Y)
+			}
+		}
+		ball.X += ball.DX
+		ball.Y += ball.DY
+	}
+
+	// The ball is nearly in the bottom right corner, and both paddles are
+	// pressed against it
+	if paddles[0].Y != fieldSize-paddles[0].Height || paddles[1].X != fieldSize-paddles[1].Width {
+		t.Fatalf("expected both paddles in the corner, got %+v", paddles)
+	}
+}
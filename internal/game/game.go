@@ -2,34 +2,88 @@ package game
 
 import (
 	"math/rand"
+	"sort"
 	"time"
 )
 
-// Game represents the main game controller
+// Game represents the main game controller. A Game is not safe for
+// concurrent use: one goroutine owns it and makes every call.
 type Game struct {
 	state     *GameState
-	tickRate  time.Duration
-	lastTick  time.Time
 	running   bool
+	paused    bool
+	pausedAt  time.Time
+
+	// How many BaseTickRate ticks each Update covers, and how far into the
+	// next input step the updates so far have got
+	step      float64
+	inputStep float64
+
+	// Bots standing in for players, and every player a bot has replaced
+	// at some point during the match
+	bots        map[int]*Bot
+	substitutes map[int]bool
+
+	// Inputs waiting to be applied, one per BaseTickRate tick, the
+	// sequence number of the latest input accepted from each player and of
+	// the latest applied
+	inputs       map[int][]Input
+	lastInputSeq map[int]uint32
+	processedSeq map[int]uint32
 }
 
-// NewGame creates a new game instance
+// maxQueuedInputs bounds how many inputs a player can have waiting. Older
+// inputs are dropped first so a burst cannot build up a backlog of movement.
+const maxQueuedInputs = 8
+
+// BaseTickRate is the tick rate speeds are given at: each second a ball
+// moves by its velocity, and a paddle by one input, this many times. A game
+// updated at another rate scales its steps to play at the same speed.
+const BaseTickRate = 60
+
+// NewGame creates a new game instance with default settings
 func NewGame() *Game {
+	return NewGameWithSettings(DefaultSettings())
+}
+
+// NewGameWithSettings creates a new game instance with the given settings
+func NewGameWithSettings(settings GameSettings) *Game {
 	// Seed random number generator
 	rand.Seed(time.Now().UnixNano())
 	
 	return &Game{
-		state:    NewGameState(),
-		tickRate: time.Second / 60, // 60 FPS
+		state:    NewGameStateWithSettings(settings),
 		running:  false,
+		step:     1,
+		bots:         make(map[int]*Bot),
+		substitutes:  make(map[int]bool),
+		inputs:       make(map[int][]Input),
+		lastInputSeq: make(map[int]uint32),
+		processedSeq: make(map[int]uint32),
 	}
 }
 
 // Start starts the game
 func (g *Game) Start() {
 	g.state.InitializeGame()
+	g.bots = make(map[int]*Bot)
+	g.substitutes = make(map[int]bool)
+	g.inputs = make(map[int][]Input)
+	g.lastInputSeq = make(map[int]uint32)
+	g.processedSeq = make(map[int]uint32)
+
 	g.running = true
-	g.lastTick = time.Now()
+	g.paused = false
+	g.inputStep = 0
+}
+
+// SetTickRate sets how many times per second Update will be called, so
+// that the game plays at the same speed whatever the rate
+func (g *Game) SetTickRate(rate int) {
+	if rate <= 0 {
+		rate = BaseTickRate
+	}
+	g.step = float64(BaseTickRate) / float64(rate)
 }
 
 // Stop stops the game
@@ -37,33 +91,77 @@ func (g *Game) Stop() {
 	g.running = false
 }
 
+// Pause freezes the game, including its clock, until Resume is called
+func (g *Game) Pause() {
+	if !g.running || g.paused {
+		return
+	}
+	g.paused = true
+	g.pausedAt = time.Now()
+}
+
+// Resume carries on a paused game. The time spent paused does not count
+// towards the time limit.
+func (g *Game) Resume() {
+	if !g.paused {
+		return
+	}
+	g.paused = false
+	g.state.StartTime = g.state.StartTime.Add(time.Since(g.pausedAt))
+}
+
+// End ends the game early with the given winner (0 for none), keeping the
+// score as it stands
+func (g *Game) End(winner int) {
+	g.Resume()
+	g.running = false
+	g.state.GameOver = true
+	g.state.Winner = winner
+	g.state.EndTime = time.Now()
+}
+
+// IsPaused returns whether the game is paused
+func (g *Game) IsPaused() bool {
+	return g.paused
+}
+
 // IsRunning returns whether the game is currently running
 func (g *Game) IsRunning() bool {
 	return g.running
 }
 
-// GetState returns the current game state
+// GetState returns a copy of the current game state that is safe to hand
+// to other goroutines
 func (g *Game) GetState() GameState {
 	return g.state.GetState()
 }
 
-// UpdatePaddle updates a paddle position
-func (g *Game) UpdatePaddle(playerID, paddleID int, x, y float64) {
-	g.state.UpdatePaddle(playerID, paddleID, x, y)
-}
+// QueueInput queues a player's movement input for the next free tick.
+// Inputs that are not newer than the last accepted one are ignored, and the
+// return value reports whether the input was accepted.
+func (g *Game) QueueInput(playerID int, input Input) bool {
+	if last, ok := g.lastInputSeq[playerID]; ok && input.Seq <= last {
+		return false
+	}
+	g.lastInputSeq[playerID] = input.Seq
 
-// Update performs one game tick update
-func (g *Game) Update() {
-	if !g.running {
-		return
+	queue := append(g.inputs[playerID], input.Clamp())
+	if len(queue) > maxQueuedInputs {
+		queue = queue[len(queue)-maxQueuedInputs:]
 	}
+	g.inputs[playerID] = queue
+	return true
+}
 
-	now := time.Now()
-	if now.Sub(g.lastTick) < g.tickRate {
+// Update performs one game tick update. The caller decides when ticks
+// happen and calls it at the rate given to SetTickRate.
+func (g *Game) Update() {
+	if !g.running || g.paused {
 		return
 	}
 
-	g.lastTick = now
+	// Move paddles from player and bot inputs
+	g.applyInputs()
 
 	// Update ball positions
 	g.updateBalls()
@@ -77,16 +175,86 @@ func (g *Game) Update() {
 	}
 }
 
+// SetBot hands a player's paddles over to a bot
+func (g *Game) SetBot(playerID int) {
+	if _, ok := g.bots[playerID]; ok {
+		return
+	}
+	g.bots[playerID] = NewBot(playerID)
+	g.substitutes[playerID] = true
+}
+
+// ClearBot returns a player's paddles to human control
+func (g *Game) ClearBot(playerID int) {
+	delete(g.bots, playerID)
+}
+
+// HasBot returns whether a bot is currently controlling a player's paddles
+func (g *Game) HasBot(playerID int) bool {
+	_, ok := g.bots[playerID]
+	return ok
+}
+
+// GetBotSubstitutes returns the players a bot has stood in for during
+// this match, in ascending order
+func (g *Game) GetBotSubstitutes() []int {
+	players := make([]int, 0, len(g.substitutes))
+	for playerID := range g.substitutes {
+		players = append(players, playerID)
+	}
+	sort.Ints(players)
+	return players
+}
+
+// GetProcessedInputs returns the sequence number of the last input applied
+// for each player, which clients use to reconcile their predictions
+func (g *Game) GetProcessedInputs() map[int]uint32 {
+	acks := make(map[int]uint32, len(g.processedSeq))
+	for playerID, seq := range g.processedSeq {
+		acks[playerID] = seq
+	}
+	return acks
+}
+
+// applyInputs moves each player's paddles by one input per BaseTickRate
+// tick this update covers: at most one when ticking at BaseTickRate or
+// faster, more when ticking slower. Players with a bot take the bot's
+// input instead of their own.
+func (g *Game) applyInputs() {
+	g.inputStep += g.step
+	steps := int(g.inputStep)
+	g.inputStep -= float64(steps)
+
+	for ; steps > 0; steps-- {
+		moves := make(map[int]Input)
+		for playerID, queue := range g.inputs {
+			if len(queue) == 0 {
+				continue
+			}
+			moves[playerID] = queue[0]
+			g.inputs[playerID] = queue[1:]
+			g.processedSeq[playerID] = queue[0].Seq
+		}
+		for playerID, bot := range g.bots {
+			moves[playerID] = bot.NextInput(g.state.Paddles, g.state.Balls, g.state.Settings.FieldSize)
+		}
+
+		for playerID, input := range moves {
+			g.state.MovePlayerPaddles(playerID, input)
+		}
+	}
+}
+
 // updateBalls updates all ball positions and checks wall collisions
 func (g *Game) updateBalls() {
-	state := g.state.GetState()
-	
+	fieldSize := g.state.Settings.FieldSize
+
 	for i := range g.state.Balls {
 		ball := &g.state.Balls[i]
-		ball.Update(state.Settings.FieldSize)
-		
+		ball.Update(fieldSize, g.step)
+
 		// Check wall collisions and handle scoring
-		if ball.CheckWallCollision(state.Settings.FieldSize) {
+		if ball.CheckWallCollision(fieldSize) {
 			// Determine which player scores based on which wall was hit
 			if ball.X <= ball.Radius || ball.Y <= ball.Radius {
 				// Left or top wall - Player 2 scores
@@ -95,21 +263,19 @@ func (g *Game) updateBalls() {
 				// Right or bottom wall - Player 1 scores
 				g.state.AddScore(1)
 			}
-			
+
 			// Reset ball to center
-			ball.Reset(state.Settings.FieldSize)
+			ball.Reset(fieldSize)
 		}
 	}
 }
 
 // checkCollisions checks for ball-paddle collisions
 func (g *Game) checkCollisions() {
-	state := g.state.GetState()
-	
 	for i := range g.state.Balls {
 		ball := &g.state.Balls[i]
-		
-		for _, paddle := range state.Paddles {
+
+		for _, paddle := range g.state.Paddles {
 			if ball.CheckPaddleCollision(paddle) {
 				break // Ball can only hit one paddle at a time
 			}
@@ -119,36 +285,34 @@ func (g *Game) checkCollisions() {
 
 // GetScore returns the current scores
 func (g *Game) GetScore() Scores {
-	state := g.state.GetState()
-	return state.Scores
+	return g.state.Scores
 }
 
 // IsGameOver returns whether the game is over
 func (g *Game) IsGameOver() bool {
-	state := g.state.GetState()
-	return state.GameOver
+	return g.state.GameOver
 }
 
 // GetWinner returns the winner (0 for tie, 1 or 2 for players)
 func (g *Game) GetWinner() int {
-	state := g.state.GetState()
-	return state.Winner
+	return g.state.Winner
 }
 
 // GetGameTime returns the elapsed game time
 func (g *Game) GetGameTime() time.Duration {
-	state := g.state.GetState()
-	if state.GameOver {
-		return state.EndTime.Sub(state.StartTime)
+	if g.state.GameOver {
+		return g.state.EndTime.Sub(g.state.StartTime)
+	}
+	if g.paused {
+		return g.pausedAt.Sub(g.state.StartTime)
 	}
-	return time.Since(state.StartTime)
+	return time.Since(g.state.StartTime)
 }
 
 // GetRemainingTime returns the remaining time if there's a time limit
 func (g *Game) GetRemainingTime() time.Duration {
-	state := g.state.GetState()
-	elapsed := time.Since(state.StartTime)
-	remaining := state.Settings.TimeLimit - elapsed
+	elapsed := g.GetGameTime()
+	remaining := g.state.Settings.TimeLimit - elapsed
 	if remaining < 0 {
 		return 0
 	}
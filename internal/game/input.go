@@ -0,0 +1,26 @@
+package game
+
+import "math"
+
+// Input is one tick's worth of movement intent from a player. Each axis
+// ranges from -1 to 1 and is scaled by the paddle speed when applied.
+type Input struct {
+	Seq        uint32  // Increases by one for every input a player sends
+	Vertical   float64 // Vertical paddle: -1 moves up, 1 moves down
+	Horizontal float64 // Horizontal paddle: -1 moves left, 1 moves right
+}
+
+// Clamp limits both axes to [-1, 1], treating invalid values as no movement
+func (in Input) Clamp() Input {
+	in.Vertical = clampAxis(in.Vertical)
+	in.Horizontal = clampAxis(in.Horizontal)
+	return in
+}
+
+// clampAxis limits a single movement axis to [-1, 1]
+func clampAxis(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return math.Max(-1, math.Min(1, v))
+}
@@ -23,32 +23,28 @@ func NewPaddle(playerID, paddleID int, x, y, width, height float64) Paddle {
 	}
 }
 
-// Move moves the paddle in the specified direction
+// Move moves the paddle along its edge by up to one step of its speed in
+// the given direction, stopping at the ends of the edge
 func (p *Paddle) Move(dx, dy float64, fieldSize int) {
-	newX := p.X + dx*p.Speed
-	newY := p.Y + dy*p.Speed
-	
-	// Constrain paddle movement based on its position
 	switch p.PaddleID {
-	case 1: // Left paddle (vertical movement only)
-		if newY >= 0 && newY+p.Height <= float64(fieldSize) {
-			p.Y = newY
-		}
-	case 2: // Top paddle (horizontal movement only)
-		if newX >= 0 && newX+p.Width <= float64(fieldSize) {
-			p.X = newX
-		}
-	case 3: // Right paddle (vertical movement only)
-		if newY >= 0 && newY+p.Height <= float64(fieldSize) {
-			p.Y = newY
-		}
-	case 4: // Bottom paddle (horizontal movement only)
-		if newX >= 0 && newX+p.Width <= float64(fieldSize) {
-			p.X = newX
-		}
+	case 1: // Vertical paddle (left or right edge)
+		p.Y = clampPosition(p.Y+dy*p.Speed, float64(fieldSize)-p.Height)
+	case 2: // Horizontal paddle (top or bottom edge)
+		p.X = clampPosition(p.X+dx*p.Speed, float64(fieldSize)-p.Width)
 	}
 }
 
+// clampPosition limits a paddle coordinate to the range [0, max]
+func clampPosition(v, max float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
 // GetCenter returns the center point of the paddle
 func (p *Paddle) GetCenter() (float64, float64) {
 	return p.X + p.Width/2, p.Y + p.Height/2
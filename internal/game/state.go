@@ -1,13 +1,13 @@
 package game
 
 import (
-	"sync"
 	"time"
 )
 
-// GameState represents the complete state of the game
+// GameState represents the complete state of the game. It is plain data
+// with no locking; the goroutine that owns the Game is the only one to
+// modify it, and other goroutines receive copies from GetState.
 type GameState struct {
-	mu       sync.RWMutex
 	Balls    []Ball
 	Paddles  []Paddle
 	Scores   Scores
@@ -34,8 +34,25 @@ type Scores struct {
 	Player2 int
 }
 
+// DefaultSettings returns the default game settings
+func DefaultSettings() GameSettings {
+	return GameSettings{
+		FieldSize:   600,
+		BallCount:   2,
+		TargetScore: 10,
+		TimeLimit:   5 * time.Minute,
+		PaddleSpeed: 5.0,
+		BallSpeed:   3.0,
+	}
+}
+
 // NewGameState creates a new game state with default settings
 func NewGameState() *GameState {
+	return NewGameStateWithSettings(DefaultSettings())
+}
+
+// NewGameStateWithSettings creates a new game state with the given settings
+func NewGameStateWithSettings(settings GameSettings) *GameState {
 	return &GameState{
 		Balls:    make([]Ball, 0),
 		Paddles:  make([]Paddle, 0),
@@ -43,22 +60,12 @@ func NewGameState() *GameState {
 		GameOver: false,
 		Winner:   0,
 		StartTime: time.Now(),
-		Settings: GameSettings{
-			FieldSize:    600,
-			BallCount:    2,
-			TargetScore:  10,
-			TimeLimit:    5 * time.Minute,
-			PaddleSpeed: 5.0,
-			BallSpeed:   3.0,
-		},
+		Settings:  settings,
 	}
 }
 
 // InitializeGame sets up the initial game state
 func (gs *GameState) InitializeGame() {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-
 	// Create paddles for both players
 	gs.Paddles = []Paddle{
 		// Player 1: Left and Top edges
@@ -68,6 +75,9 @@ func (gs *GameState) InitializeGame() {
 		NewPaddle(2, 1, 580, 300, 20, 100),    // Right paddle
 		NewPaddle(2, 2, 300, 580, 100, 20),    // Bottom paddle
 	}
+	for i := range gs.Paddles {
+		gs.Paddles[i].Speed = gs.Settings.PaddleSpeed
+	}
 
 	// Create balls
 	gs.Balls = make([]Ball, gs.Settings.BallCount)
@@ -81,11 +91,9 @@ func (gs *GameState) InitializeGame() {
 	gs.StartTime = time.Now()
 }
 
-// GetState returns a copy of the current game state for safe reading
+// GetState returns a copy of the current game state that shares no slices
+// with it
 func (gs *GameState) GetState() GameState {
-	gs.mu.RLock()
-	defer gs.mu.RUnlock()
-
 	return GameState{
 		Balls:    append([]Ball{}, gs.Balls...),
 		Paddles:  append([]Paddle{}, gs.Paddles...),
@@ -98,25 +106,17 @@ func (gs *GameState) GetState() GameState {
 	}
 }
 
-// UpdatePaddle updates a specific paddle position
-func (gs *GameState) UpdatePaddle(playerID, paddleID int, x, y float64) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-
+// MovePlayerPaddles moves both of a player's paddles by one input step
+func (gs *GameState) MovePlayerPaddles(playerID int, input Input) {
 	for i := range gs.Paddles {
-		if gs.Paddles[i].PlayerID == playerID && gs.Paddles[i].PaddleID == paddleID {
-			gs.Paddles[i].X = x
-			gs.Paddles[i].Y = y
-			break
+		if gs.Paddles[i].PlayerID == playerID {
+			gs.Paddles[i].Move(input.Horizontal, input.Vertical, gs.Settings.FieldSize)
 		}
 	}
 }
 
 // CheckGameEnd checks if the game should end and updates the winner
 func (gs *GameState) CheckGameEnd() bool {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-
 	// Check target score
 	if gs.Scores.Player1 >= gs.Settings.TargetScore {
 		gs.GameOver = true
@@ -150,9 +150,6 @@ func (gs *GameState) CheckGameEnd() bool {
 
 // AddScore increments the score for a player
 func (gs *GameState) AddScore(playerID int) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-
 	if playerID == 1 {
 		gs.Scores.Player1++
 	} else if playerID == 2 {
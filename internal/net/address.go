@@ -0,0 +1,92 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Addresses to listen on and dial can be given as URLs, which say which
+// network to use: tcp://[::1]:9000, tcp6://[::]:9000 for IPv6 only, or
+// unix:///tmp/pong.sock for a Unix domain socket. A bare host:port is TCP,
+// and the server also takes a bare port, meaning every interface.
+
+// parseAddress splits an address into the network and the address within
+// it that net.Listen and net.Dial take
+func parseAddress(addr string) (network, address string, err error) {
+	if !strings.Contains(addr, "://") {
+		if _, err := strconv.Atoi(addr); err == nil {
+			return "tcp", ":" + addr, nil
+		}
+		return "tcp", addr, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		if u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return "", "", fmt.Errorf("invalid address %q: expected %s://host:port", addr, u.Scheme)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		// unix:///tmp/pong.sock is absolute, unix://pong.sock relative
+		path := u.Host + u.Path
+		if path == "" {
+			return "", "", fmt.Errorf("invalid address %q: expected unix:///path/to/socket", addr)
+		}
+		return "unix", path, nil
+	default:
+		return "", "", fmt.Errorf("invalid address %q: unknown network %q", addr, u.Scheme)
+	}
+}
+
+// listen opens a listener on an address as parseAddress reads it. A Unix
+// socket left behind by a server that did not shut down cleanly is
+// removed first, but one a running server is still listening on is not.
+func listen(addr string) (net.Listener, error) {
+	network, address, err := parseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", address); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(address)
+			}
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// sideAddress returns the network and address to take UDP datagrams or
+// WebSocket connections on port with, on the interface the server listens
+// on. network is "udp" or "tcp". A server on every interface, or on a Unix
+// socket, takes them on every interface, keeping to IPv4 or IPv6 if its
+// listener does.
+func (s *Server) sideAddress(network, port string) (string, string) {
+	host := ""
+	if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+		switch {
+		case len(addr.IP) != 0 && !addr.IP.IsUnspecified():
+			host = addr.IP.String()
+			if addr.Zone != "" {
+				host += "%" + addr.Zone
+			}
+		case addr.IP.To4() != nil:
+			network += "4"
+		default:
+			if n, _, err := parseAddress(s.addr); err == nil && n == "tcp6" {
+				network += "6"
+			}
+		}
+	}
+	return network, net.JoinHostPort(host, port)
+}
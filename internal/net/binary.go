@@ -0,0 +1,536 @@
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"network-pong-battle/internal/game"
+)
+
+// A binary frame is a 4-byte big-endian length followed by that many
+// bytes of payload. The first payload byte says what the rest holds. The
+// high byte of the length is always zero, which is what tells a frame
+// apart from a JSON line, so no frame can be larger than maxFrameSize.
+const (
+	frameHeaderSize = 4
+	maxFrameSize    = 1<<24 - 1
+)
+
+// DefaultMaxMessageSize is the largest message either side accepts unless
+// configured otherwise, JSON line or frame payload
+const DefaultMaxMessageSize = 1 << 20
+
+// Errors reading messages. Either one means the stream can no longer be
+// trusted, so the connection is closed.
+var (
+	ErrMessageTooLarge  = errors.New("message too large")
+	ErrMalformedMessage = errors.New("malformed message")
+)
+
+// Frame kinds. States, deltas, inputs and acks, which make up nearly all
+// the traffic, have their own layouts; anything else is carried as JSON.
+const (
+	frameJSON  byte = 1
+	frameState byte = 2
+	frameInput byte = 3
+	frameDelta byte = 4
+	frameAck   byte = 5
+)
+
+// Quantization steps. Positions are kept to 1/16 px and velocities and
+// speeds to 1/256 px per tick, which is finer than anything the client
+// can draw. Input axes get a power of two so that -1, 0 and 1 and the
+// halves in between survive exactly.
+const (
+	positionScale = 16
+	velocityScale = 256
+	axisScale     = 1 << 14
+)
+
+// EncodeBinary encodes a message as a complete binary frame, length
+// prefix included.
+func EncodeBinary(msg interface{}) ([]byte, error) {
+	buf := make([]byte, frameHeaderSize, 128)
+
+	switch m := msg.(type) {
+	case *StateMessage:
+		buf = appendState(buf, m)
+	case *InputMessage:
+		buf = appendInput(buf, m)
+	case *DeltaMessage:
+		buf = appendDelta(buf, m)
+	case *AckMessage:
+		buf = append(buf, frameAck)
+		buf = binary.BigEndian.AppendUint32(buf, m.Tick)
+	default:
+		data, err := EncodeMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, frameJSON)
+		buf = append(buf, data...)
+	}
+
+	if len(buf)-frameHeaderSize > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", len(buf)-frameHeaderSize, maxFrameSize)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-frameHeaderSize))
+	return buf, nil
+}
+
+// DecodeBinary decodes the payload of a binary frame. States, deltas,
+// inputs and acks are returned as messages; for a JSON frame the JSON is
+// returned instead, to be decoded like any other JSON message.
+func DecodeBinary(payload []byte) (msg interface{}, data []byte, err error) {
+	if len(payload) == 0 {
+		return nil, nil, fmt.Errorf("empty frame")
+	}
+
+	r := &frameDecoder{buf: payload[1:]}
+	switch payload[0] {
+	case frameJSON:
+		return nil, payload[1:], nil
+	case frameState:
+		msg = r.state()
+	case frameInput:
+		msg = r.input()
+	case frameDelta:
+		msg = r.delta()
+	case frameAck:
+		msg = &AckMessage{Type: MessageTypeAck, Tick: r.uint32()}
+	default:
+		return nil, nil, fmt.Errorf("unknown frame kind %d", payload[0])
+	}
+
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if len(r.buf) > 0 {
+		return nil, nil, fmt.Errorf("%d trailing bytes in frame", len(r.buf))
+	}
+	return msg, nil, nil
+}
+
+// appendState appends a state frame. Scores, times and acks come first,
+// then the balls and paddles. Fields that never change during a game,
+// such as ball radius and paddle size, are sent once per frame rather
+// than once per ball or paddle: every ball shares a radius and speed,
+// every paddle a speed, and a paddle's size follows from whether it is
+// vertical (PaddleID 1) or horizontal (PaddleID 2).
+func appendState(buf []byte, m *StateMessage) []byte {
+	buf = append(buf, frameState)
+	buf = binary.BigEndian.AppendUint32(buf, m.Tick)
+	buf = appendTimes(buf, m.ServerTime, m.GameTime, m.Remaining)
+	buf = appendScores(buf, m.Scores)
+
+	var flags byte
+	if m.GameOver {
+		flags |= 1
+	}
+	buf = append(buf, flags, byte(m.Winner))
+	buf = appendAcks(buf, m.InputAcks)
+
+	var radius, ballSpeed, paddleSpeed, length, thickness float64
+	if len(m.Balls) > 0 {
+		radius, ballSpeed = m.Balls[0].Radius, m.Balls[0].Speed
+	}
+	if len(m.Paddles) > 0 {
+		p := m.Paddles[0]
+		paddleSpeed = p.Speed
+		length, thickness = math.Max(p.Width, p.Height), math.Min(p.Width, p.Height)
+	}
+	buf = appendFixed(buf, radius, positionScale)
+	buf = appendFixed(buf, ballSpeed, velocityScale)
+	buf = appendFixed(buf, paddleSpeed, velocityScale)
+	buf = appendFixed(buf, length, positionScale)
+	buf = appendFixed(buf, thickness, positionScale)
+
+	buf = append(buf, byte(len(m.Balls)))
+	for _, b := range m.Balls {
+		buf = appendFixed(buf, b.X, positionScale)
+		buf = appendFixed(buf, b.Y, positionScale)
+		buf = appendFixed(buf, b.DX, velocityScale)
+		buf = appendFixed(buf, b.DY, velocityScale)
+	}
+
+	buf = append(buf, byte(len(m.Paddles)))
+	for _, p := range m.Paddles {
+		buf = append(buf, byte(p.PlayerID<<4|p.PaddleID&0x0f))
+		buf = appendFixed(buf, p.X, positionScale)
+		buf = appendFixed(buf, p.Y, positionScale)
+	}
+	return buf
+}
+
+// appendDelta appends a delta frame. It follows the state layout, except
+// that the scores are only there if a flag says so and each ball and
+// paddle is preceded by its index.
+func appendDelta(buf []byte, m *DeltaMessage) []byte {
+	buf = append(buf, frameDelta)
+	buf = binary.BigEndian.AppendUint32(buf, m.Tick)
+	buf = binary.BigEndian.AppendUint32(buf, m.Base)
+	buf = appendTimes(buf, m.ServerTime, m.GameTime, m.Remaining)
+
+	var flags byte
+	if m.GameOver {
+		flags |= 1
+	}
+	if m.Scores != nil {
+		flags |= 2
+	}
+	buf = append(buf, flags, byte(m.Winner))
+	if m.Scores != nil {
+		buf = appendScores(buf, *m.Scores)
+	}
+	buf = appendAcks(buf, m.InputAcks)
+
+	buf = append(buf, byte(len(m.Balls)))
+	for _, b := range m.Balls {
+		buf = append(buf, byte(b.Index))
+		buf = appendFixed(buf, b.X, positionScale)
+		buf = appendFixed(buf, b.Y, positionScale)
+		buf = appendFixed(buf, b.DX, velocityScale)
+		buf = appendFixed(buf, b.DY, velocityScale)
+	}
+
+	buf = append(buf, byte(len(m.Paddles)))
+	for _, p := range m.Paddles {
+		buf = append(buf, byte(p.Index))
+		buf = appendFixed(buf, p.X, positionScale)
+		buf = appendFixed(buf, p.Y, positionScale)
+	}
+	return buf
+}
+
+func appendTimes(buf []byte, serverTime, gameTime, remaining int64) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(serverTime))
+	buf = binary.BigEndian.AppendUint32(buf, clampUint32(gameTime))
+	return binary.BigEndian.AppendUint32(buf, clampUint32(remaining))
+}
+
+func appendScores(buf []byte, scores game.Scores) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, clampUint16(scores.Player1))
+	return binary.BigEndian.AppendUint16(buf, clampUint16(scores.Player2))
+}
+
+func appendAcks(buf []byte, acks map[int]uint32) []byte {
+	buf = append(buf, byte(len(acks)))
+	for playerID, seq := range acks {
+		buf = append(buf, byte(playerID))
+		buf = binary.BigEndian.AppendUint32(buf, seq)
+	}
+	return buf
+}
+
+// appendInput appends an input frame
+func appendInput(buf []byte, m *InputMessage) []byte {
+	buf = append(buf, frameInput, byte(m.PlayerID))
+	buf = binary.BigEndian.AppendUint32(buf, m.Seq)
+	buf = appendFixed(buf, m.Vertical, axisScale)
+	buf = appendFixed(buf, m.Horizontal, axisScale)
+	return buf
+}
+
+// appendFixed appends v as a 16-bit fixed-point number with the given
+// scale, saturating at the ends of the range.
+func appendFixed(buf []byte, v, scale float64) []byte {
+	q := math.Round(v * scale)
+	if q > math.MaxInt16 {
+		q = math.MaxInt16
+	} else if q < math.MinInt16 {
+		q = math.MinInt16
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(int16(q)))
+}
+
+func clampUint32(v int64) uint32 {
+	if v < 0 {
+		return 0
+	}
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
+
+func clampUint16(v int) uint16 {
+	if v < 0 {
+		return 0
+	}
+	if v > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(v)
+}
+
+// frameDecoder reads fields off the front of a frame payload. The first
+// short read sets err, and every read after that returns zero.
+type frameDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *frameDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = fmt.Errorf("frame truncated")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *frameDecoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *frameDecoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *frameDecoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *frameDecoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *frameDecoder) fixed(scale float64) float64 {
+	return float64(int16(d.uint16())) / scale
+}
+
+func (d *frameDecoder) times() (serverTime, gameTime, remaining int64) {
+	serverTime = int64(d.uint64())
+	gameTime = int64(d.uint32())
+	remaining = int64(d.uint32())
+	return
+}
+
+func (d *frameDecoder) scores() game.Scores {
+	player1 := int(d.uint16())
+	return game.Scores{Player1: player1, Player2: int(d.uint16())}
+}
+
+func (d *frameDecoder) acks() map[int]uint32 {
+	n := int(d.byte())
+	if n == 0 {
+		return nil
+	}
+	acks := make(map[int]uint32, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		playerID := int(d.byte())
+		acks[playerID] = d.uint32()
+	}
+	return acks
+}
+
+func (d *frameDecoder) state() *StateMessage {
+	m := &StateMessage{Type: MessageTypeState}
+	m.Tick = d.uint32()
+	m.ServerTime, m.GameTime, m.Remaining = d.times()
+	m.Scores = d.scores()
+	m.GameOver = d.byte()&1 != 0
+	m.Winner = int(d.byte())
+	m.InputAcks = d.acks()
+
+	radius := d.fixed(positionScale)
+	ballSpeed := d.fixed(velocityScale)
+	paddleSpeed := d.fixed(velocityScale)
+	length := d.fixed(positionScale)
+	thickness := d.fixed(positionScale)
+
+	n := int(d.byte())
+	m.Balls = make([]game.Ball, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		b := game.Ball{Radius: radius, Speed: ballSpeed}
+		b.X = d.fixed(positionScale)
+		b.Y = d.fixed(positionScale)
+		b.DX = d.fixed(velocityScale)
+		b.DY = d.fixed(velocityScale)
+		m.Balls = append(m.Balls, b)
+	}
+
+	n = int(d.byte())
+	m.Paddles = make([]game.Paddle, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		ids := d.byte()
+		p := game.Paddle{PlayerID: int(ids >> 4), PaddleID: int(ids & 0x0f), Speed: paddleSpeed}
+		p.X = d.fixed(positionScale)
+		p.Y = d.fixed(positionScale)
+		if p.PaddleID == 1 {
+			p.Width, p.Height = thickness, length
+		} else {
+			p.Width, p.Height = length, thickness
+		}
+		m.Paddles = append(m.Paddles, p)
+	}
+	return m
+}
+
+func (d *frameDecoder) delta() *DeltaMessage {
+	m := &DeltaMessage{Type: MessageTypeDelta}
+	m.Tick = d.uint32()
+	m.Base = d.uint32()
+	m.ServerTime, m.GameTime, m.Remaining = d.times()
+	flags := d.byte()
+	m.GameOver = flags&1 != 0
+	m.Winner = int(d.byte())
+	if flags&2 != 0 {
+		scores := d.scores()
+		m.Scores = &scores
+	}
+	m.InputAcks = d.acks()
+
+	n := int(d.byte())
+	for i := 0; i < n && d.err == nil; i++ {
+		b := BallDelta{Index: int(d.byte())}
+		b.X = d.fixed(positionScale)
+		b.Y = d.fixed(positionScale)
+		b.DX = d.fixed(velocityScale)
+		b.DY = d.fixed(velocityScale)
+		m.Balls = append(m.Balls, b)
+	}
+
+	n = int(d.byte())
+	for i := 0; i < n && d.err == nil; i++ {
+		p := PaddleDelta{Index: int(d.byte())}
+		p.X = d.fixed(positionScale)
+		p.Y = d.fixed(positionScale)
+		m.Paddles = append(m.Paddles, p)
+	}
+	return m
+}
+
+func (d *frameDecoder) input() *InputMessage {
+	m := &InputMessage{Type: MessageTypeInput}
+	m.PlayerID = int(d.byte())
+	m.Seq = d.uint32()
+	m.Vertical = d.fixed(axisScale)
+	m.Horizontal = d.fixed(axisScale)
+	return m
+}
+
+// messageReader reads messages off a connection that may carry both
+// newline-delimited JSON and binary frames. A JSON message always starts
+// with '{' while a frame starts with the high byte of its length, which
+// is always zero, so each message can be told apart by its first byte.
+// That lets either side switch encodings without the two directions
+// having to agree on the exact message where it happens.
+type messageReader struct {
+	r       *bufio.Reader
+	maxSize int
+}
+
+// newMessageReader reads messages of up to maxSize bytes from r. Zero or
+// less means DefaultMaxMessageSize.
+func newMessageReader(r io.Reader, maxSize int) *messageReader {
+	return &messageReader{r: bufio.NewReader(r), maxSize: messageSizeLimit(maxSize)}
+}
+
+// messageSizeLimit returns the size limit to use for a configured one,
+// DefaultMaxMessageSize for zero or less and at most maxFrameSize
+func messageSizeLimit(maxSize int) int {
+	if maxSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	if maxSize > maxFrameSize {
+		return maxFrameSize
+	}
+	return maxSize
+}
+
+// next returns the next message and whether it came in a binary frame.
+// For a frame the returned bytes are its payload. They are only valid
+// until the next call. A message over the size limit gives an error
+// wrapping ErrMessageTooLarge, and bytes that are neither JSON nor a
+// frame one wrapping ErrMalformedMessage.
+func (mr *messageReader) next() ([]byte, bool, error) {
+	for {
+		first, err := mr.r.Peek(1)
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch first[0] {
+		case '\n', '\r':
+			mr.r.Discard(1)
+			continue
+		case '{':
+			line, err := mr.readLine()
+			return line, false, err
+		case 0:
+		default:
+			return nil, false, fmt.Errorf("%w: expected a JSON message or a binary frame, got byte 0x%02x",
+				ErrMalformedMessage, first[0])
+		}
+
+		header := make([]byte, frameHeaderSize)
+		if _, err := io.ReadFull(mr.r, header); err != nil {
+			return nil, false, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size == 0 {
+			return nil, false, fmt.Errorf("%w: empty frame", ErrMalformedMessage)
+		}
+		if size > uint32(mr.maxSize) {
+			return nil, false, fmt.Errorf("%w: frame of %d bytes exceeds the %d byte limit",
+				ErrMessageTooLarge, size, mr.maxSize)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(mr.r, payload); err != nil {
+			return nil, false, err
+		}
+		return payload, true, nil
+	}
+}
+
+// readLine reads a JSON line, which may be longer than the buffer but not
+// than the size limit. A last line with no newline before the end of the
+// stream still counts.
+func (mr *messageReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := mr.r.ReadSlice('\n')
+		if len(line)+len(trimNewline(chunk)) > mr.maxSize {
+			return nil, fmt.Errorf("%w: JSON message longer than %d bytes", ErrMessageTooLarge, mr.maxSize)
+		}
+		if err == bufio.ErrBufferFull {
+			line = append(line, chunk...)
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line)+len(chunk) == 0) {
+			return nil, err
+		}
+		if line == nil {
+			return trimNewline(chunk), nil
+		}
+		return trimNewline(append(line, chunk...)), nil
+	}
+}
+
+func trimNewline(line []byte) []byte {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
+}
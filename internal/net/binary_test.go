@@ -0,0 +1,197 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"network-pong-battle/internal/game"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testState returns a state message for a game in progress with the
+// default settings
+func testState() *StateMessage {
+	state := game.NewGameState()
+	state.InitializeGame()
+	state.StartTime = time.Now().Add(-42 * time.Second)
+	state.Scores = game.Scores{Player1: 3, Player2: 7}
+	for i := range state.Balls {
+		state.Balls[i].X += 123.456 * float64(i+1)
+		state.Balls[i].Y -= 98.765 * float64(i+1)
+	}
+	return CreateStateMessage(*state, map[int]uint32{1: 1200, 2: 987})
+}
+
+// TestBinaryStateRoundTrip checks that a state survives the binary
+// encoding to within its quantization step
+func TestBinaryStateRoundTrip(t *testing.T) {
+	want := testState()
+	frame, err := EncodeBinary(want)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	msg, data, err := DecodeBinary(frame[frameHeaderSize:])
+	if err != nil || data != nil {
+		t.Fatalf("decode: %v (json %q)", err, data)
+	}
+	got := msg.(*StateMessage)
+
+	near := func(what string, a, b, step float64) {
+		t.Helper()
+		if math.Abs(a-b) > step/2 {
+			t.Errorf("%s: got %v, want %v", what, a, b)
+		}
+	}
+	if got.Scores != want.Scores || got.GameTime != want.GameTime || got.Remaining != want.Remaining ||
+		got.ServerTime != want.ServerTime || got.InputAcks[1] != 1200 || got.InputAcks[2] != 987 {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, want)
+	}
+	if len(got.Balls) != len(want.Balls) || len(got.Paddles) != len(want.Paddles) {
+		t.Fatalf("got %d balls and %d paddles, want %d and %d",
+			len(got.Balls), len(got.Paddles), len(want.Balls), len(want.Paddles))
+	}
+	for i, b := range want.Balls {
+		near("ball x", got.Balls[i].X, b.X, 1.0/positionScale)
+		near("ball y", got.Balls[i].Y, b.Y, 1.0/positionScale)
+		near("ball dx", got.Balls[i].DX, b.DX, 1.0/velocityScale)
+		near("ball dy", got.Balls[i].DY, b.DY, 1.0/velocityScale)
+		near("ball radius", got.Balls[i].Radius, b.Radius, 1.0/positionScale)
+		near("ball speed", got.Balls[i].Speed, b.Speed, 1.0/velocityScale)
+	}
+	for i, p := range want.Paddles {
+		q := got.Paddles[i]
+		if q.PlayerID != p.PlayerID || q.PaddleID != p.PaddleID || q.Width != p.Width || q.Height != p.Height {
+			t.Errorf("paddle %d: got %+v, want %+v", i, q, p)
+		}
+		near("paddle x", q.X, p.X, 1.0/positionScale)
+		near("paddle y", q.Y, p.Y, 1.0/positionScale)
+		near("paddle speed", q.Speed, p.Speed, 1.0/velocityScale)
+	}
+}
+
+// TestMessageReaderMixed checks that JSON lines and binary frames can be
+// read off the same stream
+func TestMessageReaderMixed(t *testing.T) {
+	var stream bytes.Buffer
+	hello, _ := EncodeMessage(CreateHelloMessage("Ada", RolePlayer, nil))
+	stream.Write(append(hello, '\n'))
+	input, _ := EncodeBinary(CreateInputMessage(2, game.Input{Seq: 9, Vertical: -1, Horizontal: 0.5}))
+	stream.Write(input)
+	ping, _ := EncodeBinary(CreatePingMessage(1, time.Now()))
+	stream.Write(ping)
+
+	reader := newMessageReader(&stream, 0)
+	data, binary, err := reader.next()
+	if err != nil || binary || !bytes.Equal(data, hello) {
+		t.Fatalf("expected the hello as JSON, got %q binary=%v err=%v", data, binary, err)
+	}
+
+	data, binary, err = reader.next()
+	if err != nil || !binary {
+		t.Fatalf("expected an input frame, got binary=%v err=%v", binary, err)
+	}
+	msg, _, err := DecodeBinary(data)
+	if in, ok := msg.(*InputMessage); err != nil || !ok || in.PlayerID != 2 || in.Seq != 9 || in.Vertical != -1 || in.Horizontal != 0.5 {
+		t.Fatalf("bad input frame: %+v, %v", msg, err)
+	}
+
+	data, binary, err = reader.next()
+	if err != nil || !binary {
+		t.Fatalf("expected a ping frame, got binary=%v err=%v", binary, err)
+	}
+	if _, json, err := DecodeBinary(data); err != nil || json == nil {
+		t.Fatalf("expected JSON inside the ping frame, got %q, %v", json, err)
+	}
+}
+
+// TestMessageReaderLimits checks that messages over the size limit and
+// bytes that are neither JSON nor a frame give the matching errors
+func TestMessageReaderLimits(t *testing.T) {
+	frame, _ := EncodeBinary(testState())
+	tests := []struct {
+		name   string
+		stream []byte
+		want   error
+	}{
+		{"long line", []byte(`{"type":"ping","padding":"` + strings.Repeat("x", 200) + `"}`), ErrMessageTooLarge},
+		{"long frame", append([]byte{0, 0, 1, 0}, make([]byte, 256)...), ErrMessageTooLarge},
+		{"empty frame", []byte{0, 0, 0, 0}, ErrMalformedMessage},
+		{"garbage", []byte("GET / HTTP/1.1\r\n"), ErrMalformedMessage},
+	}
+	for _, test := range tests {
+		_, _, err := newMessageReader(bytes.NewReader(test.stream), 100).next()
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if _, _, err := newMessageReader(bytes.NewReader(frame), len(frame)-frameHeaderSize).next(); err != nil {
+		t.Fatalf("frame at the limit: %v", err)
+	}
+}
+
+// benchmarkEncode encodes the same state repeatedly and reports its size,
+// and the bandwidth one client needs at the server's 60 Hz tick rate
+func benchmarkEncode(b *testing.B, encode func(interface{}) ([]byte, error)) {
+	msg := testState()
+	size := 0
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := encode(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+	b.ReportMetric(float64(size*60), "bytes/sec@60Hz")
+}
+
+func BenchmarkEncodeStateJSON(b *testing.B) {
+	benchmarkEncode(b, func(msg interface{}) ([]byte, error) {
+		data, err := EncodeMessage(msg)
+		return append(data, '\n'), err
+	})
+}
+
+func BenchmarkEncodeStateBinary(b *testing.B) {
+	benchmarkEncode(b, EncodeBinary)
+}
+
+// BenchmarkEncodeDeltaBinary measures a typical delta, with the balls
+// moved and the paddles where they were
+func BenchmarkEncodeDeltaBinary(b *testing.B) {
+	base := testState()
+	state := nextState(base)
+	state.Paddles = base.Paddles
+	state.Scores = base.Scores
+	for i := range state.Balls {
+		state.Balls[i].Y++
+	}
+	delta := CreateDeltaMessage(base, state)
+	benchmarkEncode(b, func(interface{}) ([]byte, error) { return EncodeBinary(delta) })
+}
+
+func BenchmarkDecodeStateJSON(b *testing.B) {
+	data, _ := EncodeMessage(testState())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg StateMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeStateBinary(b *testing.B) {
+	frame, _ := EncodeBinary(testState())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := DecodeBinary(frame[frameHeaderSize:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package net
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"network-pong-battle/internal/game"
+	"os"
 	"sync"
 	"time"
 )
@@ -16,65 +20,343 @@ type GameClient struct {
 	conn       net.Conn
 	serverAddr string
 	playerID   int
+	roomID     string
 	playerName string
+	spectator  bool
 	connected  bool
+	inputSeq   uint32
+	predictor  *predictor
+	snapshots  *SnapshotBuffer
+	latency    *latencyTracker
 	mu         sync.RWMutex
+	writeMu    sync.Mutex
+	recvMu     sync.Mutex // held while handling a message from either transport
+
+	// The token that gets our seat back if the connection drops, and
+	// whether Disconnect was called so we should not try
+	resumeToken string
+	closed      bool
+
+	// The role we say hello with, and the protocol version and features
+	// the server agreed to in its welcome
+	role     string
+	version  int
+	features []string
+
+	// Whether to offer binary frames in our hello, and whether the server
+	// agreed so that we now send them. sendBinary is guarded by writeMu.
+	offerBinary bool
+	sendBinary  bool
+
+	// Whether to offer UDP, the UDP socket once the server has given us a
+	// port, and whether the server has bound it so that inputs and acks
+	// now go over it. udpConn and sendUDP are guarded by writeMu.
+	offerUDP bool
+	udpConn  net.Conn
+	sendUDP  bool
+
+	// The largest message we accept from the server, and how long it may
+	// go quiet before we take the connection for dead
+	maxMessageSize int
+	idleTimeout    time.Duration
+
+	// The TLS configuration to connect with, or nil for plain TCP
+	tlsConfig *tls.Config
+
+	lastError *ServerError
+
+	// Everyone in our room, from the latest roster message
+	roster []RosterEntry
+
+	// Recent snapshots to apply deltas to, the tick of the latest, and
+	// whether we asked for a keyframe after a delta we could not apply.
+	// ended is set once the game is over, from when the end message comes
+	// until the next start. Guarded by recvMu.
+	history           snapshotHistory
+	lastTick          uint32
+	keyframeRequested bool
+	ended             bool
 
 	// Callbacks for handling server messages
 	onStateUpdate func(game.GameState)
 	onGameStart   func(game.GameSettings)
-	onGameEnd     func(int, game.Scores, int64)
+	onGameEnd     func(int, game.Scores, int64, string)
 	onJoin        func(int, string)
+	onRoomList    func([]RoomInfo)
+	onRoomCreated func(roomID, name, code string)
+	onError       func(*ServerError)
+	onPause       func(paused bool, playerID int, grace time.Duration)
+	onRoster      func([]RosterEntry)
 
 	// Input channel
 	inputChan chan *InputMessage
-	stopChan  chan bool
+
+	// stop is closed by Disconnect, and wg counts every goroutine the
+	// client has started so Run can wait for them
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
-// NewClient creates a new game client
+// ServerError is an error the server reported in an error message, or a
+// message from the server we could not read. After a fatal error the
+// connection is closed.
+type ServerError struct {
+	Code    string // one of the Error constants
+	Message string
+	Fatal   bool
+}
+
+// Error returns the server's message along with the error code
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// NewClient creates a new game client. serverAddr is a host:port, or a URL
+// such as tcp://[::1]:9000 or unix:///tmp/pong.sock.
 func NewClient(serverAddr, playerName string) *GameClient {
 	return &GameClient{
 		serverAddr: serverAddr,
 		playerName: playerName,
+		role:       RolePlayer,
 		connected:  false,
+		snapshots:  NewSnapshotBuffer(),
+		latency:    newLatencyTracker(),
 		inputChan:  make(chan *InputMessage, 100),
-		stopChan:   make(chan bool),
+		stop:       make(chan struct{}),
+
+		offerBinary: true,
+		idleTimeout: DefaultIdleTimeout,
 	}
 }
 
+// Backoff between attempts to reconnect after losing the connection
+const (
+	reconnectAttempts = 8
+	reconnectMinDelay = 250 * time.Millisecond
+	reconnectMaxDelay = 5 * time.Second
+)
+
 // Connect connects to the game server
 func (c *GameClient) Connect() error {
-	var err error
-	c.conn, err = net.Dial("tcp", c.serverAddr)
+	if err := c.dial(); err != nil {
+		return err
+	}
+	c.goTracked(c.inputHandler)
+	return nil
+}
+
+// Run connects to the game server and stays connected, reconnecting if
+// need be, until ctx is done, Disconnect is called or the connection is
+// lost for good. It disconnects and returns once every goroutine the
+// client started has exited.
+func (c *GameClient) Run(ctx context.Context) error {
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-c.stop:
+	}
+	c.Disconnect()
+	c.wg.Wait()
+	return nil
+}
+
+// goTracked runs fn on its own goroutine, which Run waits for
+func (c *GameClient) goTracked(fn func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+}
+
+// dial opens a connection to the server and starts reading from it and
+// pinging over it
+func (c *GameClient) dial() error {
+	c.mu.RLock()
+	tlsConfig := c.tlsConfig
+	c.mu.RUnlock()
+
+	network, address, err := parseAddress(c.serverAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %v", err)
+	}
+	var conn net.Conn
+	if tlsConfig != nil {
+		conn, err = tls.Dial(network, address, tlsConfig)
+	} else {
+		conn, err = net.Dial(network, address)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %v", err)
 	}
 
+	// Disconnect may have been called while we were dialing
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("client is disconnected")
+	}
+	c.writeMu.Lock()
+	c.conn = conn
+	c.sendBinary = false
+	c.closeUDP()
+	c.writeMu.Unlock()
 	c.connected = true
+	c.mu.Unlock()
 	log.Printf("Connected to server at %s", c.serverAddr)
 
 	// Start message handling
-	go c.handleServerMessages()
-	go c.inputHandler()
+	done := make(chan struct{})
+	c.goTracked(func() { c.handleServerMessages(conn, done) })
+	c.goTracked(func() { c.pingLoop(done) })
 
-	return nil
+	c.mu.RLock()
+	features := []string{FeatureEncodingJSON, FeatureDeltaSnapshots}
+	if c.offerBinary {
+		features = append(features, FeatureEncodingBinary)
+	}
+	if c.offerUDP {
+		features = append(features, FeatureTransportUDP)
+	}
+	hello := CreateHelloMessage(c.playerName, c.role, features)
+	c.mu.RUnlock()
+	return c.send(hello)
+}
+
+// SetRole sets the role to ask for when connecting, RolePlayer or
+// RoleSpectator. Call it before Connect.
+func (c *GameClient) SetRole(role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+// SetBinaryEncoding sets whether to offer the binary encoding when
+// connecting. It is on by default; turning it off keeps every message in
+// readable JSON, which helps when debugging. Call it before Connect.
+func (c *GameClient) SetBinaryEncoding(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offerBinary = enabled
+}
+
+// SetUDP sets whether to ask for snapshots and inputs to go over UDP when
+// connecting. Everything else stays on TCP, and if the server does not
+// offer UDP or cannot be reached over it, so does everything. Call it
+// before Connect.
+func (c *GameClient) SetUDP(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offerUDP = enabled
+}
+
+// SetMaxMessageSize sets the largest message to accept from the server, in
+// bytes. A bigger one is reported as a fatal error and the connection is
+// dropped. Zero means DefaultMaxMessageSize. Call it before Connect.
+func (c *GameClient) SetMaxMessageSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxMessageSize = size
+}
+
+// SetIdleTimeout sets how long the server may go quiet before the
+// connection is taken for dead and dropped, which starts a reconnect if we
+// hold a seat. The server pings every second, so only a dead connection
+// goes that quiet. Zero disables it. Call it before Connect.
+func (c *GameClient) SetIdleTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idleTimeout = timeout
+}
+
+// SetTLS sets the TLS configuration to connect with, as made by
+// ClientTLSConfig. Nil, the default, connects over plain TCP. Call it
+// before Connect.
+func (c *GameClient) SetTLS(config *tls.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = config
+}
+
+// UsingUDP returns whether inputs and snapshots are going over UDP
+func (c *GameClient) UsingUDP() bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.sendUDP
+}
+
+// GetProtocolVersion returns the protocol version agreed with the server,
+// or 0 before the server has answered our hello
+func (c *GameClient) GetProtocolVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+// HasFeature returns whether the server agreed to use a protocol feature
+func (c *GameClient) HasFeature(feature string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, f := range c.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
 }
 
-// Disconnect disconnects from the server
+// reconnect dials the server again after the connection dropped, backing
+// off between attempts, and asks for our seat back. It gives up at once if
+// Disconnect is called, and disconnects for good if every attempt fails.
+func (c *GameClient) reconnect(token string) {
+	delay := reconnectMinDelay
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+
+		if err := c.dial(); err != nil {
+			log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+			continue
+		}
+		if err := c.send(CreateResumeMessage(token)); err != nil {
+			log.Printf("Error sending resume message: %v", err)
+			continue
+		}
+		return
+	}
+	log.Printf("Giving up reconnecting after %d attempts", reconnectAttempts)
+	c.Disconnect()
+}
+
+// Disconnect disconnects from the server and stops every goroutine the
+// client started. It does not wait for them; Run does. Calling it again
+// does nothing.
 func (c *GameClient) Disconnect() {
 	c.mu.Lock()
 	c.connected = false
+	c.closed = true
 	c.mu.Unlock()
 
+	c.writeMu.Lock()
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	c.closeUDP()
+	c.writeMu.Unlock()
 
-	// Signal stop
-	select {
-	case c.stopChan <- true:
-	default:
-	}
+	c.stopOnce.Do(func() { close(c.stop) })
 }
 
 // IsConnected returns whether the client is connected
@@ -86,14 +368,149 @@ func (c *GameClient) IsConnected() bool {
 
 // GetPlayerID returns the player ID assigned by the server
 func (c *GameClient) GetPlayerID() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.playerID
 }
 
+// GetPredictedPaddles returns the local player's paddles with all sent
+// input applied, including input the server has not acknowledged yet
+func (c *GameClient) GetPredictedPaddles() []game.Paddle {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.predictor == nil {
+		return nil
+	}
+	return append([]game.Paddle{}, c.predictor.paddles...)
+}
+
+// GetInterpolatedState returns the game state to render at the given time,
+// sampled from the snapshot buffer with the interpolation delay applied.
+// The second return value is false until the first state has arrived.
+func (c *GameClient) GetInterpolatedState(now time.Time) (game.GameState, bool) {
+	return c.snapshots.Sample(now)
+}
+
+// GetInterpolationDelay returns how far behind the newest snapshot the
+// interpolated state is currently sampled
+func (c *GameClient) GetInterpolationDelay() time.Duration {
+	return c.snapshots.Delay()
+}
+
+// GetNetworkStats returns the measured round trip time, jitter, loss and
+// clock offset to the server
+func (c *GameClient) GetNetworkStats() NetworkStats {
+	return c.latency.stats()
+}
+
+// ServerTimeToLocal converts a server timestamp in Unix milliseconds, such
+// as StateMessage.ServerTime, to the matching local time
+func (c *GameClient) ServerTimeToLocal(serverTime int64) time.Time {
+	return time.UnixMilli(serverTime).Add(-c.latency.stats().ClockOffset)
+}
+
+// EstimatedServerTime returns the server clock's reading at local time now
+func (c *GameClient) EstimatedServerTime(now time.Time) time.Time {
+	return now.Add(c.latency.stats().ClockOffset)
+}
+
+// GetRoomID returns the room the client has joined, or "" before joining
+func (c *GameClient) GetRoomID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.roomID
+}
+
+// SetRoomListCallback sets the function called when a room list arrives
+func (c *GameClient) SetRoomListCallback(onRoomList func([]RoomInfo)) {
+	c.onRoomList = onRoomList
+}
+
+// ListRooms asks the server for its rooms. The answer arrives through the
+// room list callback.
+func (c *GameClient) ListRooms() error {
+	return c.send(CreateListRoomsMessage())
+}
+
+// SetRoomCreatedCallback sets the function called when a room this client
+// asked for is created
+func (c *GameClient) SetRoomCreatedCallback(onRoomCreated func(roomID, name, code string)) {
+	c.onRoomCreated = onRoomCreated
+}
+
+// SetErrorCallback sets the function called when the server reports an
+// error
+func (c *GameClient) SetErrorCallback(onError func(*ServerError)) {
+	c.onError = onError
+}
+
+// LastError returns the last error the server reported, or nil
+func (c *GameClient) LastError() *ServerError {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastError
+}
+
+// CreateRoom asks the server to create a room with the given settings and
+// seat this client in it. Private rooms are left out of room lists and can
+// only be joined with their code; a non-empty password is required to join.
+func (c *GameClient) CreateRoom(name string, private bool, password string, settings RoomSettings) error {
+	msg := CreateCreateRoomMessage(name, private, password, settings)
+	msg.PlayerName = c.playerName
+	return c.send(msg)
+}
+
+// JoinRoom asks the server to seat this client in a room, found by join
+// code if one is given and by roomID otherwise. If both are empty it joins
+// any public room with a free seat.
+func (c *GameClient) JoinRoom(roomID, code, password string) error {
+	msg := CreateJoinRoomMessage(roomID, code, password)
+	msg.PlayerName = c.playerName
+	return c.send(msg)
+}
+
+// Spectate asks the server to let this client watch a room without playing,
+// found the same way as JoinRoom. If roomID and code are both empty it
+// watches any public room, preferring one whose game has started.
+func (c *GameClient) Spectate(roomID, code, password string) error {
+	msg := CreateJoinRoomMessage(roomID, code, password)
+	msg.Spectate = true
+	msg.PlayerName = c.playerName
+	return c.send(msg)
+}
+
+// SetRosterCallback sets the function called with everyone in our room
+// whenever someone joins, leaves or loses their connection
+func (c *GameClient) SetRosterCallback(onRoster func([]RosterEntry)) {
+	c.onRoster = onRoster
+}
+
+// GetRoster returns everyone in our room, as of the latest roster
+func (c *GameClient) GetRoster() []RosterEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]RosterEntry{}, c.roster...)
+}
+
+// IsSpectator returns whether this client joined its room as a spectator
+func (c *GameClient) IsSpectator() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.spectator
+}
+
+// SetPauseCallback sets the function called when the server pauses the
+// game to wait for a player to reconnect, and when it carries on
+func (c *GameClient) SetPauseCallback(onPause func(paused bool, playerID int, grace time.Duration)) {
+	c.onPause = onPause
+}
+
 // SetCallbacks sets the callback functions for handling server messages
 func (c *GameClient) SetCallbacks(
 	onStateUpdate func(game.GameState),
 	onGameStart func(game.GameSettings),
-	onGameEnd func(int, game.Scores, int64),
+	onGameEnd func(int, game.Scores, int64, string),
 	onJoin func(int, string),
 ) {
 	c.onStateUpdate = onStateUpdate
@@ -102,13 +519,29 @@ func (c *GameClient) SetCallbacks(
 	c.onJoin = onJoin
 }
 
-// SendInput sends player input to the server
-func (c *GameClient) SendInput(paddle1Y, paddle2X float64) {
+// SendInput sends one tick of movement intent to the server. Each axis
+// ranges from -1 to 1; the server decides how far the paddles move.
+func (c *GameClient) SendInput(vertical, horizontal float64) {
 	if !c.IsConnected() {
 		return
 	}
 
-	msg := CreateInputMessage(c.playerID, paddle1Y, paddle2X)
+	c.mu.Lock()
+	if c.spectator {
+		c.mu.Unlock()
+		return // Spectators have no paddles to move
+	}
+	c.inputSeq++
+	playerID := c.playerID
+	input := game.Input{Seq: c.inputSeq, Vertical: vertical, Horizontal: horizontal}.Clamp()
+
+	// Move our paddles right away rather than waiting for the server
+	if c.predictor != nil {
+		c.predictor.apply(input)
+	}
+	c.mu.Unlock()
+
+	msg := CreateInputMessage(playerID, input)
 	select {
 	case c.inputChan <- msg:
 	default:
@@ -116,23 +549,195 @@ func (c *GameClient) SendInput(paddle1Y, paddle2X float64) {
 	}
 }
 
-// handleServerMessages handles incoming messages from the server
-func (c *GameClient) handleServerMessages() {
-	scanner := bufio.NewScanner(c.conn)
-	for scanner.Scan() && c.IsConnected() {
-		data := scanner.Bytes()
-		if len(data) == 0 {
-			continue
+// handleServerMessages handles incoming messages from the server. If the
+// connection drops while we hold a seat, it starts reconnecting.
+func (c *GameClient) handleServerMessages(conn net.Conn, done chan struct{}) {
+	defer close(done)
+
+	c.mu.RLock()
+	reader := newMessageReader(conn, c.maxMessageSize)
+	idleTimeout := c.idleTimeout
+	c.mu.RUnlock()
+	for c.IsConnected() {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		data, binary, err := reader.next()
+		if err != nil {
+			c.readFailed(err)
+			break
 		}
 
-		c.processMessage(data)
+		c.recvMu.Lock()
+		if binary {
+			c.processFrame(data)
+		} else {
+			c.processMessage(data)
+		}
+		c.recvMu.Unlock()
 	}
 
+	c.mu.Lock()
+	c.connected = false
+	token := c.resumeToken
+	if c.closed {
+		token = ""
+	}
+	c.mu.Unlock()
+	conn.Close()
 	log.Println("Server connection closed")
+
+	if token == "" {
+		// Nothing to come back to
+		c.Disconnect()
+		return
+	}
+	log.Println("Trying to reconnect...")
+	c.goTracked(func() { c.reconnect(token) })
+}
+
+// readFailed handles an error reading from the server. The server hanging
+// up is a normal disconnect. A message over the size limit or bytes that
+// make no sense mean the stream cannot be trusted, and trying again would
+// most likely go the same way, so they are reported like a fatal server
+// error. Anything else is logged and we reconnect as usual.
+func (c *GameClient) readFailed(err error) {
+	var code string
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+		return
+	case errors.Is(err, ErrMessageTooLarge):
+		code = ErrorMessageTooLarge
+	case errors.Is(err, ErrMalformedMessage):
+		code = ErrorBadInput
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Printf("Nothing from the server for a while, dropping the connection")
+		return
+	default:
+		log.Printf("Error reading from server: %v", err)
+		return
+	}
+
+	readErr := &ServerError{Code: code, Message: err.Error(), Fatal: true}
+	c.mu.Lock()
+	c.lastError = readErr
+	c.closed = true
+	c.mu.Unlock()
+	log.Printf("Error reading from server: %v", readErr)
+	if c.onError != nil {
+		c.onError(readErr)
+	}
+}
+
+// processFrame processes a binary frame from the server
+func (c *GameClient) processFrame(payload []byte) {
+	msg, data, err := DecodeBinary(payload)
+	if err != nil {
+		log.Printf("Error decoding frame: %v", err)
+		return
+	}
+	if data != nil {
+		c.processMessage(data)
+		return
+	}
+
+	switch m := msg.(type) {
+	case *StateMessage:
+		c.processKeyframe(m)
+	case *DeltaMessage:
+		c.processDelta(m)
+	default:
+		log.Printf("Unexpected %T frame", msg)
+	}
+}
+
+// processKeyframe handles a full snapshot from the server
+func (c *GameClient) processKeyframe(msg *StateMessage) {
+	c.keyframeRequested = false
+	c.processSnapshot(msg)
+}
+
+// processDelta rebuilds a snapshot from a delta. If we no longer have the
+// snapshot it is against, some snapshots went missing and we ask the
+// server for a keyframe.
+func (c *GameClient) processDelta(delta *DeltaMessage) {
+	base := c.history.get(delta.Base)
+	if base == nil {
+		c.requestKeyframe(fmt.Sprintf("no snapshot %d for delta %d", delta.Base, delta.Tick))
+		return
+	}
+
+	state, err := delta.Apply(base)
+	if err != nil {
+		c.requestKeyframe(err.Error())
+		return
+	}
+	c.processSnapshot(state)
+}
+
+// requestKeyframe asks the server for a full snapshot, unless we already
+// have and are waiting for it
+func (c *GameClient) requestKeyframe(reason string) {
+	if c.keyframeRequested {
+		return
+	}
+	log.Printf("Requesting a keyframe: %s", reason)
+	c.keyframeRequested = true
+	if err := c.send(CreateKeyframeRequestMessage()); err != nil {
+		log.Printf("Error requesting keyframe: %v", err)
+	}
+}
+
+// processSnapshot keeps a full snapshot to apply later deltas to and
+// acknowledges it, then applies it
+func (c *GameClient) processSnapshot(msg *StateMessage) {
+	if msg.Tick != 0 {
+		if msg.Tick <= c.lastTick {
+			return // Older than what we have
+		}
+		c.lastTick = msg.Tick
+		c.history.add(msg)
+
+		if c.HasFeature(FeatureDeltaSnapshots) && !c.IsSpectator() {
+			if err := c.send(CreateAckMessage(msg.Tick)); err != nil {
+				log.Printf("Error acknowledging snapshot: %v", err)
+			}
+		}
+	}
+	c.processState(msg)
+}
+
+// processState applies a state snapshot from the server
+func (c *GameClient) processState(msg *StateMessage) {
+	// Replay unacknowledged input on top of the server's paddles
+	paddles := msg.Paddles
+	c.mu.Lock()
+	if c.predictor != nil {
+		c.predictor.reconcile(msg.Paddles, msg.InputAcks[c.predictor.playerID])
+		paddles = c.predictor.overlay(msg.Paddles)
+	}
+	c.mu.Unlock()
+
+	// Convert to game state
+	state := game.GameState{
+		Balls:    msg.Balls,
+		Paddles:  paddles,
+		Scores:   msg.Scores,
+		GameOver: msg.GameOver,
+		Winner:   msg.Winner,
+	}
+
+	c.snapshots.Push(state, msg.Tick, time.Now())
+
+	if c.onStateUpdate != nil {
+		c.onStateUpdate(state)
+	}
 }
 
 // processMessage processes a single message from the server
 func (c *GameClient) processMessage(data []byte) {
+	receivedAt := time.Now()
+
 	// Try to determine message type first
 	var baseMsg struct {
 		Type MessageType `json:"type"`
@@ -150,11 +755,29 @@ func (c *GameClient) processMessage(data []byte) {
 			log.Printf("Error decoding join message: %v", err)
 			return
 		}
+		c.mu.Lock()
 		c.playerID = msg.PlayerID
+		c.roomID = msg.RoomID
+		c.spectator = msg.Spectator
+		c.resumeToken = msg.ResumeToken
+		c.predictor = nil
+		if !msg.Spectator {
+			c.predictor = newPredictor(msg.PlayerID, game.DefaultSettings().FieldSize)
+		}
+		c.mu.Unlock()
+		c.snapshots.Reset() // Anything buffered is from before a reconnect
+		c.snapshots.SetTickRate(msg.TickRate)
+		c.history.reset()
+		c.lastTick = 0
+		c.ended = false
 		if c.onJoin != nil {
 			c.onJoin(msg.PlayerID, msg.PlayerName)
 		}
-		log.Printf("Joined game as Player %d", c.playerID)
+		if msg.Spectator {
+			log.Printf("Watching room %s as a spectator", msg.RoomID)
+		} else {
+			log.Printf("Joined room %s as Player %d (%q)", msg.RoomID, msg.PlayerID, msg.PlayerName)
+		}
 
 	case MessageTypeStart:
 		var msg StartMessage
@@ -163,6 +786,12 @@ func (c *GameClient) processMessage(data []byte) {
 			return
 		}
 		log.Printf("Received game start message")
+		c.ended = false
+		c.mu.Lock()
+		if c.predictor != nil {
+			c.predictor.fieldSize = msg.Settings.FieldSize
+		}
+		c.mu.Unlock()
 		if c.onGameStart != nil {
 			c.onGameStart(msg.Settings)
 		}
@@ -175,17 +804,15 @@ func (c *GameClient) processMessage(data []byte) {
 			return
 		}
 
-		// Convert to game state
-		state := game.GameState{
-			Balls:    msg.Balls,
-			Paddles:  msg.Paddles,
-			GameOver: msg.GameOver,
-			Winner:   msg.Winner,
-		}
+		c.processKeyframe(&msg)
 
-		if c.onStateUpdate != nil {
-			c.onStateUpdate(state)
+	case MessageTypeDelta:
+		var msg DeltaMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding delta message: %v", err)
+			return
 		}
+		c.processDelta(&msg)
 
 	case MessageTypeEnd:
 		var msg EndMessage
@@ -193,10 +820,127 @@ func (c *GameClient) processMessage(data []byte) {
 			log.Printf("Error decoding end message: %v", err)
 			return
 		}
+		c.ended = true
+		if msg.Reason == EndReasonShutdown {
+			// The server is going away, so there is no seat to come back to
+			c.mu.Lock()
+			c.resumeToken = ""
+			c.mu.Unlock()
+		}
 		if c.onGameEnd != nil {
-			c.onGameEnd(msg.Winner, msg.FinalScores, msg.GameTime)
+			c.onGameEnd(msg.Winner, msg.FinalScores, msg.GameTime, msg.Reason)
+		}
+		log.Printf("Game ended (%s)! Winner: Player %d", msg.Reason, msg.Winner)
+		for _, playerID := range msg.BotPlayers {
+			log.Printf("A bot substituted for Player %d", playerID)
+		}
+
+	case MessageTypeWelcome:
+		var msg WelcomeMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding welcome message: %v", err)
+			return
+		}
+		c.mu.Lock()
+		c.version = msg.Version
+		c.features = msg.Features
+		c.mu.Unlock()
+		// The server sends frames from here on, and so do we
+		binary := c.HasFeature(FeatureEncodingBinary)
+		c.writeMu.Lock()
+		c.sendBinary = binary
+		c.writeMu.Unlock()
+		log.Printf("Server speaks protocol %d, features %v", msg.Version, msg.Features)
+		if c.HasFeature(FeatureTransportUDP) && msg.UDPPort != 0 {
+			c.goTracked(func() { c.dialUDP(msg.UDPPort, msg.UDPToken) })
+		}
+
+	case MessageTypeError:
+		var msg ErrorMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding error message: %v", err)
+			return
+		}
+		serverErr := &ServerError{Code: msg.Code, Message: msg.Message, Fatal: msg.Fatal}
+		c.mu.Lock()
+		c.lastError = serverErr
+		if msg.Fatal {
+			// The server hangs up after this, and trying again will not help
+			c.closed = true
+		}
+		c.mu.Unlock()
+		log.Printf("Server error: %v", serverErr)
+		if c.onError != nil {
+			c.onError(serverErr)
+		}
+
+	case MessageTypeRoomList:
+		var msg RoomListMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding room list message: %v", err)
+			return
+		}
+		if c.onRoomList != nil {
+			c.onRoomList(msg.Rooms)
+		}
+
+	case MessageTypeRoomCreated:
+		var msg RoomCreatedMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding room created message: %v", err)
+			return
+		}
+		log.Printf("Created room %s (%q), join code %s", msg.RoomID, msg.Name, msg.Code)
+		if c.onRoomCreated != nil {
+			c.onRoomCreated(msg.RoomID, msg.Name, msg.Code)
+		}
+
+	case MessageTypePing:
+		var msg PingMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding ping message: %v", err)
+			return
+		}
+		if err := c.send(createPong(&msg, receivedAt)); err != nil {
+			log.Printf("Error sending pong: %v", err)
+		}
+
+	case MessageTypePaused:
+		var msg PausedMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding paused message: %v", err)
+			return
+		}
+		grace := time.Duration(msg.Grace) * time.Millisecond
+		if msg.Paused {
+			log.Printf("Game paused, waiting up to %v for Player %d to reconnect", grace, msg.PlayerID)
+		} else {
+			log.Println("Game resumed")
 		}
-		log.Printf("Game ended! Winner: Player %d", msg.Winner)
+		if c.onPause != nil {
+			c.onPause(msg.Paused, msg.PlayerID, grace)
+		}
+
+	case MessageTypeRoster:
+		var msg RosterMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding roster message: %v", err)
+			return
+		}
+		c.mu.Lock()
+		c.roster = msg.Entries
+		c.mu.Unlock()
+		if c.onRoster != nil {
+			c.onRoster(msg.Entries)
+		}
+
+	case MessageTypePong:
+		var msg PongMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			log.Printf("Error decoding pong message: %v", err)
+			return
+		}
+		c.latency.handlePong(&msg, receivedAt)
 
 	default:
 		log.Printf("Unknown message type: %s", baseMsg.Type)
@@ -210,24 +954,15 @@ func (c *GameClient) inputHandler() {
 
 	for {
 		select {
-		case <-c.stopChan:
+		case <-c.stop:
 			return
 		case <-ticker.C:
 			select {
 			case msg := <-c.inputChan:
 				if c.IsConnected() {
-					data, err := EncodeMessage(msg)
-					if err != nil {
-						log.Printf("Error encoding input message: %v", err)
-						continue
-					}
-					data = append(data, '\n')
-
-					c.mu.Lock()
-					if c.conn != nil {
-						c.conn.Write(data)
+					if err := c.send(msg); err != nil {
+						log.Printf("Error sending input message: %v", err)
 					}
-					c.mu.Unlock()
 				}
 			default:
 				// No input to send
@@ -235,3 +970,57 @@ func (c *GameClient) inputHandler() {
 		}
 	}
 }
+
+// pingLoop pings the server once per pingInterval until done is closed
+func (c *GameClient) pingLoop(done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.send(c.latency.nextPing(time.Now())); err != nil {
+				log.Printf("Error sending ping: %v", err)
+			}
+		}
+	}
+}
+
+// send encodes and writes a single message to the server
+func (c *GameClient) send(msg interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	// Inputs and acks go by UDP once it is bound; a lost one is made up
+	// for by the next
+	switch msg.(type) {
+	case *InputMessage, *AckMessage:
+		if c.sendUDP {
+			frame, err := EncodeBinary(msg)
+			if err != nil {
+				return fmt.Errorf("failed to encode message: %v", err)
+			}
+			_, err = c.udpConn.Write(frame)
+			return err
+		}
+	}
+
+	var data []byte
+	var err error
+	if c.sendBinary {
+		data, err = EncodeBinary(msg)
+	} else if data, err = EncodeMessage(msg); err == nil {
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+
+	_, err = c.conn.Write(data)
+	return err
+}
@@ -0,0 +1,135 @@
+package net
+
+import (
+	"fmt"
+
+	"network-pong-battle/internal/game"
+)
+
+// snapshotHistorySize is how many ticks of snapshots are kept to send or
+// apply deltas against. How long that is depends on the tick rate: a
+// little over two seconds at the default 60 ticks a second, half that at
+// 120. A client whose latest ack is more ticks old than that gets a
+// keyframe.
+const snapshotHistorySize = 128
+
+// snapshotHistory keeps the most recent snapshots by tick
+type snapshotHistory struct {
+	snapshots [snapshotHistorySize]*StateMessage
+}
+
+// add records a snapshot, replacing the one snapshotHistorySize ticks older
+func (h *snapshotHistory) add(state *StateMessage) {
+	h.snapshots[state.Tick%snapshotHistorySize] = state
+}
+
+// get returns the snapshot for tick, or nil if it is not kept
+func (h *snapshotHistory) get(tick uint32) *StateMessage {
+	state := h.snapshots[tick%snapshotHistorySize]
+	if state == nil || state.Tick != tick {
+		return nil
+	}
+	return state
+}
+
+// reset forgets every snapshot
+func (h *snapshotHistory) reset() {
+	*h = snapshotHistory{}
+}
+
+// CreateDeltaMessage creates a delta that turns base into state. Both must
+// have the same number of balls and paddles.
+func CreateDeltaMessage(base, state *StateMessage) *DeltaMessage {
+	delta := &DeltaMessage{
+		Type:       MessageTypeDelta,
+		Tick:       state.Tick,
+		Base:       base.Tick,
+		GameOver:   state.GameOver,
+		Winner:     state.Winner,
+		GameTime:   state.GameTime,
+		Remaining:  state.Remaining,
+		ServerTime: state.ServerTime,
+	}
+
+	for i, b := range state.Balls {
+		old := base.Balls[i]
+		if b.X != old.X || b.Y != old.Y || b.DX != old.DX || b.DY != old.DY {
+			delta.Balls = append(delta.Balls, BallDelta{Index: i, X: b.X, Y: b.Y, DX: b.DX, DY: b.DY})
+		}
+	}
+	for i, p := range state.Paddles {
+		old := base.Paddles[i]
+		if p.X != old.X || p.Y != old.Y {
+			delta.Paddles = append(delta.Paddles, PaddleDelta{Index: i, X: p.X, Y: p.Y})
+		}
+	}
+
+	if state.Scores != base.Scores {
+		scores := state.Scores
+		delta.Scores = &scores
+	}
+	for playerID, seq := range state.InputAcks {
+		if base.InputAcks[playerID] != seq {
+			if delta.InputAcks == nil {
+				delta.InputAcks = make(map[int]uint32)
+			}
+			delta.InputAcks[playerID] = seq
+		}
+	}
+	return delta
+}
+
+// canDelta reports whether state can be sent as a delta against base
+func canDelta(base, state *StateMessage) bool {
+	return len(base.Balls) == len(state.Balls) && len(base.Paddles) == len(state.Paddles)
+}
+
+// Apply rebuilds the full snapshot the delta was made from. base must be
+// the snapshot with tick d.Base; it is not modified.
+func (d *DeltaMessage) Apply(base *StateMessage) (*StateMessage, error) {
+	if base.Tick != d.Base {
+		return nil, fmt.Errorf("delta is against tick %d, not %d", d.Base, base.Tick)
+	}
+
+	state := &StateMessage{
+		Type:       MessageTypeState,
+		Tick:       d.Tick,
+		Balls:      append([]game.Ball(nil), base.Balls...),
+		Paddles:    append([]game.Paddle(nil), base.Paddles...),
+		Scores:     base.Scores,
+		GameOver:   d.GameOver,
+		Winner:     d.Winner,
+		GameTime:   d.GameTime,
+		Remaining:  d.Remaining,
+		ServerTime: d.ServerTime,
+	}
+
+	for _, b := range d.Balls {
+		if b.Index < 0 || b.Index >= len(state.Balls) {
+			return nil, fmt.Errorf("delta moves ball %d of %d", b.Index, len(state.Balls))
+		}
+		ball := &state.Balls[b.Index]
+		ball.X, ball.Y, ball.DX, ball.DY = b.X, b.Y, b.DX, b.DY
+	}
+	for _, p := range d.Paddles {
+		if p.Index < 0 || p.Index >= len(state.Paddles) {
+			return nil, fmt.Errorf("delta moves paddle %d of %d", p.Index, len(state.Paddles))
+		}
+		paddle := &state.Paddles[p.Index]
+		paddle.X, paddle.Y = p.X, p.Y
+	}
+
+	if d.Scores != nil {
+		state.Scores = *d.Scores
+	}
+	if len(base.InputAcks) > 0 || len(d.InputAcks) > 0 {
+		state.InputAcks = make(map[int]uint32, len(base.InputAcks))
+		for playerID, seq := range base.InputAcks {
+			state.InputAcks[playerID] = seq
+		}
+		for playerID, seq := range d.InputAcks {
+			state.InputAcks[playerID] = seq
+		}
+	}
+	return state, nil
+}
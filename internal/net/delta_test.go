@@ -0,0 +1,73 @@
+package net
+
+import (
+	"reflect"
+	"testing"
+)
+
+// nextState returns a copy of state one tick later, with the first ball
+// and the last paddle moved and a point scored
+func nextState(state *StateMessage) *StateMessage {
+	next := *state
+	next.Tick++
+	next.Balls = append(next.Balls[:0:0], state.Balls...)
+	next.Paddles = append(next.Paddles[:0:0], state.Paddles...)
+	next.Balls[0].X += 3
+	next.Balls[0].DY = -next.Balls[0].DY
+	next.Paddles[len(next.Paddles)-1].X -= 5
+	next.Scores.Player2++
+	next.InputAcks = map[int]uint32{1: state.InputAcks[1], 2: state.InputAcks[2] + 1}
+	next.GameTime += 16
+	return &next
+}
+
+// TestDeltaRoundTrip checks that a delta only carries what changed and
+// rebuilds the snapshot it was made from, both as JSON and as a frame
+func TestDeltaRoundTrip(t *testing.T) {
+	base := testState()
+	base.Tick = 7
+	state := nextState(base)
+
+	delta := CreateDeltaMessage(base, state)
+	if delta.Base != 7 || delta.Tick != 8 || len(delta.Balls) != 1 || len(delta.Paddles) != 1 ||
+		delta.Scores == nil || len(delta.InputAcks) != 1 {
+		t.Fatalf("delta carries more or less than what changed: %+v", delta)
+	}
+
+	rebuilt, err := delta.Apply(base)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !reflect.DeepEqual(rebuilt, state) {
+		t.Fatalf("rebuilt %+v, want %+v", rebuilt, state)
+	}
+
+	var decoded DeltaMessage
+	data, _ := EncodeMessage(delta)
+	if err := DecodeMessage(data, &decoded); err != nil || !reflect.DeepEqual(&decoded, delta) {
+		t.Fatalf("JSON round trip gave %+v, %v", decoded, err)
+	}
+
+	// Frames quantize, so compare against the base as a client decodes it
+	frame, _ := EncodeBinary(base)
+	msg, _, _ := DecodeBinary(frame[frameHeaderSize:])
+	quantizedBase := msg.(*StateMessage)
+	frame, _ = EncodeBinary(delta)
+	msg, _, err = DecodeBinary(frame[frameHeaderSize:])
+	if err != nil {
+		t.Fatalf("decode delta frame: %v", err)
+	}
+	rebuilt, err = msg.(*DeltaMessage).Apply(quantizedBase)
+	if err != nil {
+		t.Fatalf("apply decoded delta: %v", err)
+	}
+	frame, _ = EncodeBinary(state)
+	msg, _, _ = DecodeBinary(frame[frameHeaderSize:])
+	if !reflect.DeepEqual(rebuilt, msg.(*StateMessage)) {
+		t.Fatalf("rebuilt %+v from frames, want %+v", rebuilt, msg)
+	}
+
+	if _, err := delta.Apply(state); err == nil {
+		t.Fatal("expected a delta applied to the wrong base to fail")
+	}
+}
@@ -0,0 +1,287 @@
+package net
+
+import (
+	"math"
+	"network-pong-battle/internal/game"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSnapshots bounds how many snapshots the buffer keeps
+	maxSnapshots = 64
+
+	// Bounds for the adaptive interpolation delay
+	minInterpolationDelay = 20 * time.Millisecond
+	maxInterpolationDelay = 250 * time.Millisecond
+
+	// maxExtrapolation is how far past the newest snapshot positions are
+	// projected when a packet is late, before they are held still
+	maxExtrapolation = 100 * time.Millisecond
+
+	// snapDistance is how far an object may move between two snapshots
+	// before it is treated as a teleport (such as a ball reset) rather
+	// than interpolated
+	snapDistance = 100.0
+)
+
+// snapshot is a game state stamped with the server tick it was taken at
+// and the local time it arrived
+type snapshot struct {
+	tick     uint32
+	received time.Time
+	state    game.GameState
+}
+
+// SnapshotBuffer is a jitter buffer of server snapshots. The renderer
+// samples it slightly in the past so there is almost always a snapshot on
+// each side of the sample time to interpolate between. The delay grows and
+// shrinks with the measured jitter in snapshot arrival.
+//
+// Snapshots are placed on the timeline by their tick, at origin plus that
+// many ticks, rather than by when they arrived: the server may send them
+// every few ticks, at a rate that changes, and the network delays each one
+// differently. origin follows the earliest any snapshot has arrived for
+// its tick. Snapshots without a tick are placed where they arrived.
+type SnapshotBuffer struct {
+	mu          sync.Mutex
+	snapshots   []snapshot
+	tickLength  time.Duration // how long a server tick is
+	origin      time.Time     // local time of tick zero
+	lastArrival time.Time
+	lastTick    uint32
+	interval    time.Duration // smoothed time between arrivals
+	jitter      time.Duration // smoothed variation in transit time
+	delay       time.Duration
+}
+
+// NewSnapshotBuffer creates an empty snapshot buffer
+func NewSnapshotBuffer() *SnapshotBuffer {
+	interval := time.Second / game.BaseTickRate
+	return &SnapshotBuffer{
+		snapshots:  make([]snapshot, 0, maxSnapshots),
+		tickLength: interval,
+		interval:   interval,
+		delay:      2 * interval,
+	}
+}
+
+// SetTickRate sets how many ticks per second the server counts in the
+// snapshots it sends. Zero means game.BaseTickRate.
+func (b *SnapshotBuffer) SetTickRate(rate int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate <= 0 {
+		rate = game.BaseTickRate
+	}
+	b.tickLength = time.Second / time.Duration(rate)
+	b.origin = time.Time{}
+}
+
+// Push adds a snapshot taken at the given server tick, or zero if unknown,
+// and received at the given local time
+func (b *SnapshotBuffer) Push(state game.GameState, tick uint32, received time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A tick going backwards is a new game clock, such as another room's
+	if tick != 0 && tick <= b.lastTick {
+		b.snapshots = b.snapshots[:0]
+		b.origin = time.Time{}
+		b.lastArrival = time.Time{}
+	}
+
+	// Smooth the arrival interval and the jitter, in the style of RFC 3550:
+	// how much more or less time passed between arrivals than between the
+	// ticks the snapshots were taken at
+	if !b.lastArrival.IsZero() {
+		gap := received.Sub(b.lastArrival)
+		expected := b.interval
+		if tick != 0 && b.lastTick != 0 {
+			expected = time.Duration(tick-b.lastTick) * b.tickLength
+		}
+		deviation := gap - expected
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		b.interval += (gap - b.interval) / 16
+		b.jitter += (deviation - b.jitter) / 16
+		b.adaptDelay()
+	}
+	b.lastArrival = received
+	b.lastTick = tick
+
+	// An early arrival moves the origin back at once; a late one only
+	// nudges it forward, so that a route that got slower for good is
+	// caught up with gradually
+	if tick != 0 {
+		origin := received.Add(-time.Duration(tick) * b.tickLength)
+		if b.origin.IsZero() || origin.Before(b.origin) {
+			b.origin = origin
+		} else {
+			b.origin = b.origin.Add(origin.Sub(b.origin) / 256)
+		}
+	}
+
+	if len(b.snapshots) == maxSnapshots {
+		copy(b.snapshots, b.snapshots[1:])
+		b.snapshots = b.snapshots[:maxSnapshots-1]
+	}
+	b.snapshots = append(b.snapshots, snapshot{tick: tick, received: received, state: state})
+}
+
+// at returns where a snapshot sits on the timeline. Callers hold b.mu.
+func (b *SnapshotBuffer) at(s snapshot) time.Time {
+	if s.tick == 0 || b.origin.IsZero() {
+		return s.received
+	}
+	return b.origin.Add(time.Duration(s.tick) * b.tickLength)
+}
+
+// adaptDelay eases the interpolation delay towards two arrival intervals
+// plus a margin for jitter. It moves gradually so playback does not jump.
+func (b *SnapshotBuffer) adaptDelay() {
+	target := 2*b.interval + 3*b.jitter
+	if target < minInterpolationDelay {
+		target = minInterpolationDelay
+	}
+	if target > maxInterpolationDelay {
+		target = maxInterpolationDelay
+	}
+	b.delay += (target - b.delay) / 10
+}
+
+// Delay returns the current interpolation delay
+func (b *SnapshotBuffer) Delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.delay
+}
+
+// Jitter returns the measured jitter in snapshot arrival
+func (b *SnapshotBuffer) Jitter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.jitter
+}
+
+// Reset discards all buffered snapshots
+func (b *SnapshotBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.snapshots = b.snapshots[:0]
+	b.origin = time.Time{}
+	b.lastArrival = time.Time{}
+	b.lastTick = 0
+}
+
+// Sample returns the state at now minus the interpolation delay. Between
+// two snapshots positions are interpolated; past the newest one balls are
+// extrapolated along their velocity for a short while. The second return
+// value is false if no snapshot has arrived yet.
+func (b *SnapshotBuffer) Sample(now time.Time) (game.GameState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.snapshots) == 0 {
+		return game.GameState{}, false
+	}
+
+	renderTime := now.Add(-b.delay)
+	first := b.snapshots[0]
+	last := b.snapshots[len(b.snapshots)-1]
+
+	if !renderTime.After(b.at(first)) {
+		return copyState(first.state), true
+	}
+	if !renderTime.Before(b.at(last)) {
+		return extrapolate(last.state, renderTime.Sub(b.at(last))), true
+	}
+
+	// Find the pair of snapshots either side of the render time
+	for i := len(b.snapshots) - 1; i > 0; i-- {
+		from, to := b.snapshots[i-1], b.snapshots[i]
+		if renderTime.Before(b.at(from)) {
+			continue
+		}
+		span := b.at(to).Sub(b.at(from))
+		if span <= 0 {
+			return copyState(to.state), true
+		}
+		alpha := float64(renderTime.Sub(b.at(from))) / float64(span)
+		return interpolate(from.state, to.state, alpha), true
+	}
+
+	return copyState(last.state), true
+}
+
+// interpolate blends two states. Discrete fields come from the older state;
+// balls and paddles that jumped too far between them are snapped instead.
+func interpolate(from, to game.GameState, alpha float64) game.GameState {
+	result := copyState(from)
+
+	if len(from.Balls) == len(to.Balls) {
+		for i := range result.Balls {
+			a, b := from.Balls[i], to.Balls[i]
+			if distance(a.X, a.Y, b.X, b.Y) > snapDistance {
+				result.Balls[i] = b
+				continue
+			}
+			result.Balls[i].X = lerp(a.X, b.X, alpha)
+			result.Balls[i].Y = lerp(a.Y, b.Y, alpha)
+		}
+	}
+
+	for i := range result.Paddles {
+		a := from.Paddles[i]
+		for _, b := range to.Paddles {
+			if b.PlayerID != a.PlayerID || b.PaddleID != a.PaddleID {
+				continue
+			}
+			result.Paddles[i].X = lerp(a.X, b.X, alpha)
+			result.Paddles[i].Y = lerp(a.Y, b.Y, alpha)
+		}
+	}
+
+	return result
+}
+
+// extrapolate projects balls along their velocity for elapsed time, capped
+// at maxExtrapolation. Paddles are left where they were.
+func extrapolate(state game.GameState, elapsed time.Duration) game.GameState {
+	result := copyState(state)
+	if elapsed > maxExtrapolation {
+		elapsed = maxExtrapolation
+	}
+
+	ticks := elapsed.Seconds() * game.BaseTickRate
+	for i := range result.Balls {
+		result.Balls[i].X += result.Balls[i].DX * ticks
+		result.Balls[i].Y += result.Balls[i].DY * ticks
+	}
+	return result
+}
+
+// copyState returns a copy of state that shares no slices with it
+func copyState(state game.GameState) game.GameState {
+	return game.GameState{
+		Balls:     append([]game.Ball{}, state.Balls...),
+		Paddles:   append([]game.Paddle{}, state.Paddles...),
+		Scores:    state.Scores,
+		GameOver:  state.GameOver,
+		Winner:    state.Winner,
+		StartTime: state.StartTime,
+		EndTime:   state.EndTime,
+		Settings:  state.Settings,
+	}
+}
+
+// lerp linearly interpolates between a and b
+func lerp(a, b, alpha float64) float64 {
+	return a + (b-a)*alpha
+}
+
+// distance returns the distance between two points
+func distance(x1, y1, x2, y2 float64) float64 {
+	return math.Hypot(x2-x1, y2-y1)
+}
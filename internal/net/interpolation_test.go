@@ -0,0 +1,101 @@
+package net
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"network-pong-battle/internal/game"
+)
+
+// ballAt returns a state with one ball at x moving dx per tick, and one
+// paddle
+func ballAt(x, dx float64) game.GameState {
+	return game.GameState{
+		Balls:   []game.Ball{{X: x, Y: 100, DX: dx, Radius: 5}},
+		Paddles: []game.Paddle{game.NewPaddle(1, 1, 0, 300, 10, 100)},
+	}
+}
+
+// TestSnapshotBufferSample checks interpolation between snapshots,
+// snapping when a ball jumps, and extrapolation past the newest snapshot
+// up to its cap
+func TestSnapshotBufferSample(t *testing.T) {
+	tick := time.Second / game.BaseTickRate
+	start := time.Now()
+	b := NewSnapshotBuffer()
+	b.SetTickRate(game.BaseTickRate)
+	if _, ok := b.Sample(start); ok {
+		t.Fatal("expected nothing to sample from an empty buffer")
+	}
+
+	// Snapshots arrive exactly a tick apart, and the ball is reset to the
+	// far side at tick 3
+	b.Push(ballAt(0, 3), 1, start.Add(tick))
+	b.Push(ballAt(10, 3), 2, start.Add(2*tick))
+	b.Push(ballAt(500, 3), 3, start.Add(3*tick))
+	delay := b.Delay()
+
+	for _, tc := range []struct {
+		name  string
+		at    time.Duration // the time rendered, from start
+		wantX float64
+	}{
+		{"before the oldest", 0, 0},
+		{"between two snapshots", tick + tick/4, 2.5},
+		{"across a reset", 2*tick + tick/2, 500},
+		{"extrapolated", 3*tick + 50*time.Millisecond, 500 + 3*3},
+		{"extrapolation capped", 3*tick + time.Second, 500 + 3*maxExtrapolation.Seconds()*game.BaseTickRate},
+	} {
+		state, ok := b.Sample(start.Add(tc.at + delay))
+		if !ok {
+			t.Fatalf("%s: expected a state", tc.name)
+		}
+		if math.Abs(state.Balls[0].X-tc.wantX) > 0.01 {
+			t.Errorf("%s: expected the ball at x %v, got %v", tc.name, tc.wantX, state.Balls[0].X)
+		}
+		if state.Paddles[0].Y != 300 {
+			t.Errorf("%s: expected the paddle to stay put, got y %v", tc.name, state.Paddles[0].Y)
+		}
+	}
+
+	b.Reset()
+	if _, ok := b.Sample(start.Add(3 * tick)); ok {
+		t.Fatal("expected nothing to sample after a reset")
+	}
+}
+
+// TestSnapshotBufferAdaptiveDelay checks that the delay settles near two
+// snapshot intervals when they arrive steadily, grows with jitter, and
+// stays within its bounds
+func TestSnapshotBufferAdaptiveDelay(t *testing.T) {
+	tick := time.Second / game.BaseTickRate
+
+	// settle pushes snapshots a tick apart, every other one late by jitter,
+	// and returns the delay they leave
+	settle := func(jitter time.Duration) time.Duration {
+		b := NewSnapshotBuffer()
+		b.SetTickRate(game.BaseTickRate)
+		start := time.Now()
+		for i := uint32(1); i <= 300; i++ {
+			received := start.Add(time.Duration(i) * tick)
+			if i%2 == 0 {
+				received = received.Add(jitter)
+			}
+			b.Push(ballAt(0, 0), i, received)
+		}
+		return b.Delay()
+	}
+
+	steady := settle(0)
+	if steady < 2*tick-time.Millisecond || steady > 2*tick+time.Millisecond {
+		t.Errorf("expected steady snapshots to settle near %v, got %v", 2*tick, steady)
+	}
+	jittery := settle(10 * time.Millisecond)
+	if jittery < steady+20*time.Millisecond {
+		t.Errorf("expected 10ms of jitter to add to the delay, got %v against %v steady", jittery, steady)
+	}
+	if wild := settle(time.Second); wild > maxInterpolationDelay {
+		t.Errorf("expected the delay capped at %v, got %v", maxInterpolationDelay, wild)
+	}
+}
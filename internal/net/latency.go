@@ -0,0 +1,166 @@
+package net
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// pingInterval is how often each side pings the other
+	pingInterval = time.Second
+
+	// pingTimeout is how long a ping may go unanswered before it counts
+	// as lost
+	pingTimeout = 3 * time.Second
+
+	// DefaultIdleTimeout is how long either side waits to hear anything
+	// from the other before giving up on the connection, unless configured
+	// otherwise. It allows for several pings going unanswered.
+	DefaultIdleTimeout = 10 * time.Second
+
+	// lossWindow is how many recent pings the loss estimate covers
+	lossWindow = 20
+
+	// offsetSamples is how many recent samples are considered when picking
+	// the clock offset. The sample with the lowest round trip wins, since
+	// it has the least room for asymmetric delay.
+	offsetSamples = 8
+)
+
+// NetworkStats summarises the measured quality of a connection
+type NetworkStats struct {
+	RTT         time.Duration // Smoothed round trip time
+	Jitter      time.Duration // Smoothed variation in round trip time
+	Loss        float64       // Fraction of recent pings that went unanswered
+	ClockOffset time.Duration // Add to local time to get the peer's time
+	Synced      bool          // Whether any pong has arrived yet
+}
+
+// clockSample is one round trip measurement
+type clockSample struct {
+	rtt    time.Duration
+	offset time.Duration
+}
+
+// latencyTracker measures round trip time, jitter, loss and clock offset
+// for one connection from the ping/pong exchange
+type latencyTracker struct {
+	mu          sync.Mutex
+	nextID      uint32
+	outstanding map[uint32]time.Time
+	outcomes    []bool // true for answered, oldest first
+	samples     []clockSample
+	rtt         time.Duration
+	jitter      time.Duration
+	synced      bool
+}
+
+// newLatencyTracker creates a tracker with no measurements
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		outstanding: make(map[uint32]time.Time),
+	}
+}
+
+// nextPing returns a ping to send now, expiring older pings that have gone
+// unanswered for too long
+func (t *latencyTracker) nextPing(now time.Time) *PingMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, sent := range t.outstanding {
+		if now.Sub(sent) >= pingTimeout {
+			delete(t.outstanding, id)
+			t.recordOutcome(false)
+		}
+	}
+
+	t.nextID++
+	t.outstanding[t.nextID] = now
+	return CreatePingMessage(t.nextID, now)
+}
+
+// handlePong updates the measurements from a pong received at now
+func (t *latencyTracker) handlePong(msg *PongMessage, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sent, ok := t.outstanding[msg.ID]
+	if !ok {
+		return // Already counted as lost, or not ours
+	}
+	delete(t.outstanding, msg.ID)
+	t.recordOutcome(true)
+
+	// NTP-style: remove the peer's processing time from the round trip and
+	// assume the remaining delay is split evenly between the two directions
+	peerReceived := time.UnixMicro(msg.ReceivedAt)
+	peerSent := time.UnixMicro(msg.SentAt)
+	rtt := now.Sub(sent) - peerSent.Sub(peerReceived)
+	if rtt < 0 {
+		rtt = 0
+	}
+	offset := (peerReceived.Sub(sent) + peerSent.Sub(now)) / 2
+
+	if !t.synced {
+		t.rtt = rtt
+		t.synced = true
+	} else {
+		deviation := rtt - t.rtt
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		t.jitter += (deviation - t.jitter) / 16
+		t.rtt += (rtt - t.rtt) / 8
+	}
+
+	t.samples = append(t.samples, clockSample{rtt: rtt, offset: offset})
+	if len(t.samples) > offsetSamples {
+		t.samples = t.samples[1:]
+	}
+}
+
+// recordOutcome remembers whether a ping was answered. Callers hold t.mu.
+func (t *latencyTracker) recordOutcome(answered bool) {
+	t.outcomes = append(t.outcomes, answered)
+	if len(t.outcomes) > lossWindow {
+		t.outcomes = t.outcomes[1:]
+	}
+}
+
+// stats returns the current measurements
+func (t *latencyTracker) stats() NetworkStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := NetworkStats{
+		RTT:    t.rtt,
+		Jitter: t.jitter,
+		Synced: t.synced,
+	}
+
+	if len(t.outcomes) > 0 {
+		lost := 0
+		for _, answered := range t.outcomes {
+			if !answered {
+				lost++
+			}
+		}
+		stats.Loss = float64(lost) / float64(len(t.outcomes))
+	}
+
+	var best time.Duration
+	for i, sample := range t.samples {
+		if i == 0 || sample.rtt < best {
+			best = sample.rtt
+			stats.ClockOffset = sample.offset
+		}
+	}
+
+	return stats
+}
+
+// createPong answers a ping received at receivedAt
+func createPong(ping *PingMessage, receivedAt time.Time) *PongMessage {
+	return CreatePongMessage(ping.ID, ping.SentAt, receivedAt, time.Now())
+}
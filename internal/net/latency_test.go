@@ -0,0 +1,65 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLatencyTracker feeds the tracker pings and pongs stamped by a peer
+// whose clock runs 500ms ahead, and checks the round trip, jitter, clock
+// offset and loss it works out from them
+func TestLatencyTracker(t *testing.T) {
+	const ms = time.Millisecond
+	start := time.UnixMicro(time.Now().UnixMicro())
+	peerAhead := 500 * ms
+	tr := newLatencyTracker()
+
+	// exchange sends a ping at sent, which takes out to reach the peer,
+	// is held there for hold and takes back to return, and returns when
+	// the pong arrives
+	exchange := func(sent time.Time, out, hold, back time.Duration) time.Time {
+		ping := tr.nextPing(sent)
+		peerReceived := sent.Add(out + peerAhead)
+		pong := CreatePongMessage(ping.ID, ping.SentAt, peerReceived, peerReceived.Add(hold))
+		arrived := sent.Add(out + hold + back)
+		tr.handlePong(pong, arrived)
+		return arrived
+	}
+
+	if tr.stats().Synced {
+		t.Fatal("expected no measurements before the first pong")
+	}
+
+	// 20ms each way, with 5ms spent by the peer that does not count
+	exchange(start, 20*ms, 5*ms, 20*ms)
+	stats := tr.stats()
+	if !stats.Synced || stats.RTT != 40*ms || stats.ClockOffset != peerAhead || stats.Loss != 0 {
+		t.Fatalf("expected a 40ms round trip and 500ms offset, got %+v", stats)
+	}
+
+	// A slower, lopsided round trip is smoothed in, but the offset still
+	// comes from the fastest, which has the least room for asymmetry
+	exchange(start.Add(time.Second), 60*ms, 0, 20*ms)
+	stats = tr.stats()
+	if stats.RTT != 45*ms || stats.Jitter != 2500*time.Microsecond || stats.ClockOffset != peerAhead {
+		t.Fatalf("expected a 45ms round trip, 2.5ms jitter and 500ms offset, got %+v", stats)
+	}
+
+	// A ping that goes unanswered counts as lost once the next ping is
+	// sent after it has timed out, and its pong is ignored if it turns up
+	lost := tr.nextPing(start.Add(2 * time.Second))
+	now := start.Add(2*time.Second + pingTimeout)
+	now = exchange(now, 20*ms, 0, 20*ms)
+	tr.handlePong(CreatePongMessage(lost.ID, lost.SentAt, now, now), now)
+	if stats := tr.stats(); stats.Loss != 0.25 {
+		t.Fatalf("expected one of four pings lost, got %+v", stats)
+	}
+
+	// Loss only covers the most recent pings
+	for i := 0; i < lossWindow; i++ {
+		now = exchange(now.Add(time.Second), 20*ms, 0, 20*ms)
+	}
+	if stats := tr.stats(); stats.Loss != 0 {
+		t.Fatalf("expected the lost ping to have left the window, got %+v", stats)
+	}
+}
@@ -0,0 +1,968 @@
+package net
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"network-pong-battle/internal/game"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AbandonPolicy decides how a game ends when a player leaves it for good
+type AbandonPolicy int
+
+const (
+	// AbandonPolicyForfeit awards the win to the player who stayed. If
+	// nobody stayed the game is abandoned.
+	AbandonPolicyForfeit AbandonPolicy = iota
+
+	// AbandonPolicyAbandon ends the game with no winner
+	AbandonPolicyAbandon
+)
+
+// String returns the flag name of the policy
+func (p AbandonPolicy) String() string {
+	switch p {
+	case AbandonPolicyForfeit:
+		return "forfeit"
+	case AbandonPolicyAbandon:
+		return "abandon"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAbandonPolicy parses a policy name as returned by AbandonPolicy.String
+func ParseAbandonPolicy(name string) (AbandonPolicy, error) {
+	switch name {
+	case "forfeit":
+		return AbandonPolicyForfeit, nil
+	case "abandon":
+		return AbandonPolicyAbandon, nil
+	default:
+		return 0, fmt.Errorf("unknown abandon policy %q", name)
+	}
+}
+
+// match runs the game in one room and owns everything about it: the game
+// itself, the clients playing and watching it and whether it has started.
+// Only the run goroutine touches these fields. Connection goroutines hand it
+// joins, leaves and inputs over channels, and anything else that needs to
+// look inside goes through query.
+type match struct {
+	// Fixed when the room is created, so safe to read from any goroutine
+	id           string
+	name         string
+	code         string
+	private      bool
+	passwordHash []byte
+
+	config   ServerConfig
+	settings game.GameSettings
+	game     *game.Game
+	clients  map[int]*Client
+	started  bool
+
+	// How often the game ticks, and how many snapshots a second go out.
+	// sendCredit is how far the ticks so far are towards the next one.
+	tickRate     int
+	tickInterval time.Duration
+	sendRate     float64
+	sendCredit   float64
+
+	// Each seated player's resume token and name, and when the seats of
+	// players who lost their connection mid-game are given up
+	tokens map[int]string
+	names  map[int]string
+	away   map[int]time.Time
+
+	// Spectators see the room's broadcasts SpectatorDelay late. watching
+	// is whether the game has started as far as they can see.
+	spectators map[*Client]bool
+	delayed    []delayedMessage
+	watching   bool
+
+	// Recent snapshots, which players' deltas are made against, and the
+	// number of ticks the game has run for
+	history   snapshotHistory
+	tickCount uint32
+
+	closing bool         // set once the last player has left for good
+	onClose func(*match) // called from run just before it returns
+
+	joins   chan joinRequest
+	leaves  chan *Client
+	inputs  chan clientInput
+	acks    chan clientAck
+	queries chan func()
+	stop    chan struct{} // closed to ask run to finish
+	stopped chan struct{} // closed once run has finished
+}
+
+// joinRequest asks the match to seat a client, or to let it watch. The
+// reply is false if the match has no room for it.
+type joinRequest struct {
+	client   *Client
+	spectate bool
+	token    string // resume token, for a player taking their seat back
+	reply    chan bool
+}
+
+// delayedMessage is a broadcast waiting to be passed on to spectators
+type delayedMessage struct {
+	due time.Time
+	msg interface{}
+	out outboundMessage
+}
+
+// clientInput is an input message together with the client that sent it
+type clientInput struct {
+	client *Client
+	msg    InputMessage
+}
+
+// clientAck is a client acknowledging a snapshot, or asking for a keyframe
+type clientAck struct {
+	client   *Client
+	tick     uint32
+	keyframe bool
+}
+
+// newMatch creates a match that is not running yet
+func newMatch(id, name string, settings game.GameSettings, config ServerConfig) *match {
+	tickRate := config.TickRate
+	if tickRate <= 0 {
+		tickRate = game.BaseTickRate
+	}
+	sendRate := config.SendRate
+	if sendRate <= 0 || sendRate > tickRate {
+		sendRate = tickRate
+	}
+	g := game.NewGameWithSettings(settings)
+	g.SetTickRate(tickRate)
+
+	return &match{
+		id:           id,
+		name:         name,
+		config:       config,
+		settings:     settings,
+		game:         g,
+		tickRate:     tickRate,
+		tickInterval: time.Second / time.Duration(tickRate),
+		sendRate:     float64(sendRate),
+		clients:      make(map[int]*Client),
+		spectators:   make(map[*Client]bool),
+		tokens:       make(map[int]string),
+		names:        make(map[int]string),
+		away:         make(map[int]time.Time),
+		joins:        make(chan joinRequest),
+		leaves:       make(chan *Client),
+		inputs:       make(chan clientInput, 64),
+		acks:         make(chan clientAck, 64),
+		queries:      make(chan func()),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// run is the match goroutine. It returns once stop is closed or the last
+// player has left.
+func (m *match) run() {
+	defer close(m.stopped)
+	defer func() {
+		if m.onClose != nil {
+			m.onClose(m)
+		}
+	}()
+
+	ticker := time.NewTicker(m.tickInterval)
+	defer ticker.Stop()
+	pings := time.NewTicker(pingInterval)
+	defer pings.Stop()
+
+	for pingCount := 1; ; {
+		select {
+		case <-m.stop:
+			m.announceShutdown()
+			m.shutdown()
+			return
+		case req := <-m.joins:
+			if req.token != "" {
+				req.reply <- m.resumePlayer(req.client, req.token)
+			} else if req.spectate {
+				req.reply <- m.addSpectator(req.client)
+			} else {
+				req.reply <- m.addClient(req.client)
+			}
+		case client := <-m.leaves:
+			m.removeClient(client)
+		case in := <-m.inputs:
+			m.handleInput(in.client, &in.msg)
+		case ack := <-m.acks:
+			m.handleAck(ack)
+		case fn := <-m.queries:
+			fn()
+		case <-ticker.C:
+			m.tick()
+		case <-pings.C:
+			m.pingClients(pingCount)
+			pingCount++
+		}
+
+		if m.closing {
+			m.logf("Last player left, closing room")
+			m.dismissSpectators()
+			m.shutdown()
+			return
+		}
+	}
+}
+
+// close stops the match and waits for its goroutine to finish
+func (m *match) close() {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	<-m.stopped
+}
+
+// info describes the room. It returns false if the match has stopped.
+func (m *match) info() (RoomInfo, bool) {
+	var info RoomInfo
+	ok := m.query(func() {
+		info = RoomInfo{
+			ID:         m.id,
+			Name:       m.name,
+			Players:    len(m.clients) + len(m.away),
+			MaxPlayers: 2,
+			Started:    m.started,
+			Locked:     m.passwordHash != nil,
+			Spectators: len(m.spectators),
+			Settings:   roomSettingsFrom(m.settings),
+		}
+	})
+	return info, ok
+}
+
+// logf logs a message prefixed with the room it concerns
+func (m *match) logf(format string, args ...interface{}) {
+	log.Printf("[room %s] "+format, append([]interface{}{m.id}, args...)...)
+}
+
+// join asks the match to seat a client, or to let it watch if spectate is
+// set, and reports whether it was let in
+func (m *match) join(client *Client, spectate bool) bool {
+	reply := make(chan bool, 1)
+	select {
+	case m.joins <- joinRequest{client: client, spectate: spectate, reply: reply}:
+		return <-reply
+	case <-m.stopped:
+		return false
+	}
+}
+
+// resume asks the match to give a reconnecting client the seat its token
+// was issued for, and reports whether it did
+func (m *match) resume(client *Client, token string) bool {
+	reply := make(chan bool, 1)
+	select {
+	case m.joins <- joinRequest{client: client, token: token, reply: reply}:
+		return <-reply
+	case <-m.stopped:
+		return false
+	}
+}
+
+// leave tells the match a client has disconnected
+func (m *match) leave(client *Client) {
+	select {
+	case m.leaves <- client:
+	case <-m.stopped:
+	}
+}
+
+// input passes a client's input message to the match
+func (m *match) input(client *Client, msg InputMessage) {
+	select {
+	case m.inputs <- clientInput{client: client, msg: msg}:
+	case <-m.stopped:
+	}
+}
+
+// ack passes a client's snapshot ack, or keyframe request, to the match
+func (m *match) ack(client *Client, tick uint32, keyframe bool) {
+	select {
+	case m.acks <- clientAck{client: client, tick: tick, keyframe: keyframe}:
+	case <-m.stopped:
+	}
+}
+
+// query runs fn on the match goroutine and waits for it. It returns false
+// without running fn if the match has stopped.
+func (m *match) query(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case m.queries <- func() { fn(); close(done) }:
+		<-done
+		return true
+	case <-m.stopped:
+		return false
+	}
+}
+
+// addClient seats a client in the first free player slot and starts the
+// game once both players are present
+func (m *match) addClient(client *Client) bool {
+	playerID := 0
+	for _, id := range []int{1, 2} {
+		_, taken := m.clients[id]
+		_, held := m.away[id]
+		if !taken && !held {
+			playerID = id
+			break
+		}
+	}
+	if playerID == 0 {
+		return false
+	}
+
+	token, err := newResumeToken(m.id)
+	if err != nil {
+		m.logf("Player %d will not be able to resume: %v", playerID, err)
+	}
+	m.tokens[playerID] = token
+
+	client.playerID = playerID
+	client.playerName = m.uniqueName(client.name, fmt.Sprintf("Player %d", playerID))
+	client.sendRate = newSendRate(m.sendRate)
+	m.clients[playerID] = client
+	m.names[playerID] = client.playerName
+	m.logf("Client %d (%q) connected from %s", playerID, client.playerName, client.conn.RemoteAddr())
+
+	// Send join confirmation
+	join := CreateJoinMessage(m.id, playerID, client.playerName)
+	join.ResumeToken = token
+	join.TickRate = m.tickRate
+	client.send(join)
+	m.sendRoster()
+
+	// Start game if we have both players
+	if len(m.clients) == 2 && !m.started {
+		m.logf("Two players connected, starting game...")
+		m.startGame()
+	}
+	return true
+}
+
+// addSpectator lets a client watch the match without a paddle
+func (m *match) addSpectator(client *Client) bool {
+	if m.config.MaxSpectators > 0 && len(m.spectators) >= m.config.MaxSpectators {
+		return false
+	}
+
+	client.spectator = true
+	client.playerName = m.uniqueName(client.name, "Spectator")
+	client.sendRate = newSendRate(m.sendRate)
+	m.spectators[client] = true
+	m.logf("Spectator %q connected from %s", client.playerName, client.conn.RemoteAddr())
+
+	join := CreateJoinMessage(m.id, 0, client.playerName)
+	join.Spectator = true
+	join.TickRate = m.tickRate
+	client.send(join)
+	m.sendRoster()
+
+	// Catch up with a game spectators can already see
+	if m.watching {
+		client.send(CreateStartMessage(m.settings))
+	}
+	return true
+}
+
+// resumePlayer gives a reconnecting client the seat its token was issued
+// for and brings it up to date with the game. Tokens are compared in
+// constant time, so how long a wrong guess takes says nothing about how
+// close it came.
+func (m *match) resumePlayer(client *Client, token string) bool {
+	playerID := 0
+	for id, t := range m.tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			playerID = id
+			break
+		}
+	}
+	if playerID == 0 {
+		return false
+	}
+
+	// The old connection may not have been noticed as dead yet
+	if old := m.clients[playerID]; old != nil {
+		old.queue.close()
+		old.conn.Close()
+		delete(m.clients, playerID)
+	}
+	delete(m.away, playerID)
+	if m.game.HasBot(playerID) {
+		m.game.ClearBot(playerID)
+		m.logf("Player %d is back, bot released", playerID)
+	}
+
+	// The seat keeps the name it was taken with
+	client.playerID = playerID
+	client.playerName = m.names[playerID]
+	client.lastInput = time.Now()
+	client.sendRate = newSendRate(m.sendRate)
+	m.clients[playerID] = client
+	m.logf("Player %d resumed from %s", playerID, client.conn.RemoteAddr())
+
+	join := CreateJoinMessage(m.id, playerID, client.playerName)
+	join.ResumeToken = token
+	join.TickRate = m.tickRate
+	client.send(join)
+	m.sendRoster()
+	m.unpause()
+
+	if m.started {
+		state := CreateStateMessage(m.game.GetState(), m.game.GetProcessedInputs())
+		state.Tick = m.tickCount
+		client.send(CreateStartMessage(m.game.GetState().Settings))
+		client.send(state)
+	}
+	return true
+}
+
+// removeClient forgets a disconnected client. A player who drops out of a
+// running game keeps their seat for the reconnect grace period, and the
+// game pauses until they are back, unless BotOnDisconnect has a bot play
+// for them in the meantime.
+func (m *match) removeClient(client *Client) {
+	if client.spectator {
+		if m.spectators[client] {
+			delete(m.spectators, client)
+			client.queue.close()
+			m.logf("Spectator %s disconnected", client.conn.RemoteAddr())
+			m.sendRoster()
+		}
+		return
+	}
+
+	if m.clients[client.playerID] != client {
+		return
+	}
+	delete(m.clients, client.playerID)
+	client.queue.close()
+	m.logf("Client %d disconnected", client.playerID)
+
+	grace := m.config.ReconnectGrace
+	if m.started && grace > 0 && m.tokens[client.playerID] != "" {
+		m.away[client.playerID] = time.Now().Add(grace)
+		if m.config.BotOnDisconnect && len(m.clients) > 0 {
+			m.game.SetBot(client.playerID)
+			m.logf("Bot playing for player %d, holding their seat for %v", client.playerID, grace)
+			m.sendRoster()
+			return
+		}
+		m.game.Pause()
+		m.broadcast(CreatePausedMessage(true, client.playerID, grace))
+		m.logf("Holding player %d's seat for %v", client.playerID, grace)
+		m.sendRoster()
+		return
+	}
+
+	m.vacate(client.playerID)
+}
+
+// vacate gives up a player's seat for good and decides whether the match
+// can carry on without them
+func (m *match) vacate(playerID int) {
+	delete(m.tokens, playerID)
+	delete(m.names, playerID)
+	m.sendRoster()
+
+	if len(m.clients) == 0 && len(m.away) == 0 {
+		m.closing = true
+	}
+
+	if !m.started || len(m.clients)+len(m.away) >= 2 {
+		return
+	}
+
+	// Let a bot finish the match for the missing player while someone is
+	// still playing, otherwise end the game as the abandon policy says
+	switch {
+	case m.config.BotOnDisconnect && len(m.clients) > 0:
+		m.game.SetBot(playerID)
+		m.logf("Bot substituted for disconnected player %d", playerID)
+	case m.config.AbandonPolicy == AbandonPolicyForfeit && len(m.clients) > 0:
+		m.endGame(3-playerID, EndReasonForfeit)
+	default:
+		m.endGame(0, EndReasonAbandoned)
+	}
+}
+
+// expireSeats gives up the seats of players who did not reconnect within
+// the grace period
+func (m *match) expireSeats(now time.Time) {
+	for playerID, deadline := range m.away {
+		if now.Before(deadline) {
+			continue
+		}
+		delete(m.away, playerID)
+		m.logf("Player %d did not reconnect in time", playerID)
+		m.vacate(playerID)
+	}
+	m.unpause()
+}
+
+// unpause carries on a paused game once no seat is being held
+func (m *match) unpause() {
+	if len(m.away) > 0 || !m.game.IsPaused() {
+		return
+	}
+	m.game.Resume()
+	for _, client := range m.clients {
+		client.lastInput = time.Now() // Nobody could play while paused
+	}
+	if m.started {
+		m.broadcast(CreatePausedMessage(false, 0, 0))
+		m.logf("Game resumed")
+	}
+}
+
+// handleInput queues a client's movement input
+func (m *match) handleInput(client *Client, msg *InputMessage) {
+	playerID := client.playerID
+	if m.clients[playerID] != client {
+		return // Input that raced with the client leaving
+	}
+
+	// Clients may only move their own paddles
+	if msg.PlayerID != playerID {
+		client.sendError(ErrorBadInput, fmt.Sprintf("input for player %d from player %d", msg.PlayerID, playerID), false)
+		return
+	}
+
+	client.lastInput = time.Now()
+
+	// An idle player takes back control from their bot by moving
+	if m.game.HasBot(playerID) {
+		m.game.ClearBot(playerID)
+		m.logf("Player %d is back, bot released", playerID)
+	}
+
+	m.game.QueueInput(playerID, game.Input{
+		Seq:        msg.Seq,
+		Vertical:   msg.Vertical,
+		Horizontal: msg.Horizontal,
+	})
+}
+
+// startGame starts the game
+func (m *match) startGame() {
+	m.logf("Starting game with 2 players...")
+	m.started = true
+	m.game.Start()
+	for _, client := range m.clients {
+		client.lastInput = time.Now()
+	}
+
+	// Send start message to all clients
+	m.logf("Broadcasting start message to %d clients", len(m.clients))
+	m.broadcast(CreateStartMessage(m.game.GetState().Settings))
+
+	m.logf("Game started!")
+}
+
+// endGame ends the game early, keeping the score as it stands
+func (m *match) endGame(winner int, reason string) {
+	m.game.End(winner)
+	m.finishGame(reason)
+}
+
+// finishGame tells every client the game is over and why
+func (m *match) finishGame(reason string) {
+	m.started = false
+	m.broadcast(CreateEndMessage(
+		m.game.GetWinner(),
+		m.game.GetScore(),
+		int64(m.game.GetGameTime().Milliseconds()),
+		m.game.GetBotSubstitutes(),
+		reason,
+	))
+	m.logf("Game ended (%s)! Winner: Player %d", reason, m.game.GetWinner())
+}
+
+// endByAdmin ends a running game on behalf of the server operator
+func (m *match) endByAdmin() bool {
+	ended := false
+	m.query(func() {
+		if m.started {
+			m.endGame(0, EndReasonAdmin)
+			ended = true
+		}
+	})
+	return ended
+}
+
+// tick advances the game by one step, and sends the result to the clients
+// when a snapshot is due
+func (m *match) tick() {
+	now := time.Now()
+	m.flushSpectators(now)
+	m.expireSeats(now)
+
+	if !m.started || m.game.IsPaused() {
+		return
+	}
+
+	m.checkIdlePlayers()
+	m.game.Update()
+	m.tickCount++
+
+	// Snapshots go out at the send rate, every tick or every few. The
+	// final state always goes out.
+	due := takeCredit(&m.sendCredit, m.sendRate/float64(m.tickRate))
+	if due || m.game.IsGameOver() {
+		m.broadcastState(CreateStateMessage(m.game.GetState(), m.game.GetProcessedInputs()))
+	}
+
+	// Check if game ended
+	if m.game.IsGameOver() {
+		reason := EndReasonTime
+		scores, target := m.game.GetScore(), m.settings.TargetScore
+		if scores.Player1 >= target || scores.Player2 >= target {
+			reason = EndReasonScore
+		}
+		m.finishGame(reason)
+	}
+}
+
+// checkIdlePlayers hands the paddles of players who have not sent input
+// within the idle timeout over to a bot
+func (m *match) checkIdlePlayers() {
+	if m.config.BotIdleTimeout <= 0 {
+		return
+	}
+
+	for playerID, client := range m.clients {
+		if time.Since(client.lastInput) >= m.config.BotIdleTimeout && !m.game.HasBot(playerID) {
+			m.game.SetBot(playerID)
+			m.logf("Player %d idle for %v, bot substituted", playerID, m.config.BotIdleTimeout)
+		}
+	}
+}
+
+// pingClients pings every client and periodically logs the measured
+// connection quality of each player
+func (m *match) pingClients(count int) {
+	const logEvery = 10 // pings between stats log lines
+
+	now := time.Now()
+	for client := range m.spectators {
+		client.send(client.latency.nextPing(now))
+		client.sendRate.adapt(now, client.latency.stats().RTT, client.queue.stats(), client.snapshotsSent.Load())
+	}
+
+	for _, client := range m.clients {
+		client.send(client.latency.nextPing(now))
+
+		// Each ping interval is also when send rates adapt
+		stats := client.latency.stats()
+		queue := client.queue.stats()
+		client.sendRate.adapt(now, stats.RTT, queue, client.snapshotsSent.Load())
+
+		if count%logEvery == 0 {
+			m.logf("Player %d: rtt=%v jitter=%v loss=%.0f%% offset=%v queue=%d dropped=%d rate=%.0f/s",
+				client.playerID, stats.RTT, stats.Jitter, stats.Loss*100, stats.ClockOffset,
+				queue.Depth, queue.Dropped, client.sendRate.current())
+		}
+	}
+}
+
+// broadcast queues a message for every client in the match. Spectators get
+// it once the spectator delay has passed.
+func (m *match) broadcast(msg interface{}) {
+	out, err := newOutboundMessage(msg)
+	if err != nil {
+		m.logf("Error encoding message: %v", err)
+		return
+	}
+
+	for _, client := range m.clients {
+		client.enqueue(out)
+	}
+	m.toSpectators(msg, out)
+}
+
+// broadcastState sends a snapshot to the clients whose send rate says it
+// is their turn, and to all of them once the game is over. Players that
+// agreed to delta snapshots get it as a delta against the latest snapshot
+// they acknowledged, unless a keyframe is due; everyone else, spectators
+// included, gets it whole.
+func (m *match) broadcastState(state *StateMessage) {
+	state.Tick = m.tickCount
+	m.history.add(state)
+
+	full, err := newOutboundMessage(state)
+	if err != nil {
+		m.logf("Error encoding message: %v", err)
+		return
+	}
+
+	// Players who acknowledged the same snapshot share a delta
+	deltas := make(map[uint32]outboundMessage)
+	for _, client := range m.clients {
+		if !client.sendRate.due() && !state.GameOver {
+			continue
+		}
+
+		base := m.deltaBase(client, state)
+		if base == nil {
+			client.keyframeTick = state.Tick
+			client.wantKeyframe = false
+			client.enqueue(full)
+			continue
+		}
+
+		out, ok := deltas[base.Tick]
+		if !ok {
+			if out, err = newOutboundMessage(CreateDeltaMessage(base, state)); err != nil {
+				m.logf("Error encoding message: %v", err)
+				return
+			}
+			deltas[base.Tick] = out
+		}
+		client.enqueue(out)
+	}
+	m.toSpectators(state, full)
+}
+
+// deltaBase returns the snapshot to send the client state as a delta
+// against, or nil if it should get a keyframe
+func (m *match) deltaBase(client *Client, state *StateMessage) *StateMessage {
+	if !client.deltas || client.wantKeyframe || client.ackedTick == 0 || m.config.KeyframeInterval <= 0 {
+		return nil
+	}
+	interval := uint32(m.config.KeyframeInterval / m.tickInterval)
+	if state.Tick-client.keyframeTick >= interval {
+		return nil
+	}
+	base := m.history.get(client.ackedTick)
+	if base == nil || !canDelta(base, state) {
+		return nil
+	}
+	return base
+}
+
+// handleAck records the latest snapshot a player has, or that they need a
+// keyframe
+func (m *match) handleAck(ack clientAck) {
+	client := ack.client
+	if m.clients[client.playerID] != client {
+		return // Spectators only get keyframes
+	}
+	if ack.keyframe {
+		client.wantKeyframe = true
+		return
+	}
+	if ack.tick > client.ackedTick && ack.tick <= m.tickCount {
+		client.ackedTick = ack.tick
+	}
+}
+
+// toSpectators passes a broadcast on to spectators, after SpectatorDelay
+func (m *match) toSpectators(msg interface{}, out outboundMessage) {
+	if m.config.SpectatorDelay <= 0 {
+		m.spectate(msg, out)
+		return
+	}
+	m.delayed = append(m.delayed, delayedMessage{
+		due: time.Now().Add(m.config.SpectatorDelay),
+		msg: msg,
+		out: out,
+	})
+}
+
+// flushSpectators passes on the delayed broadcasts that are due
+func (m *match) flushSpectators(now time.Time) {
+	due := 0
+	for due < len(m.delayed) && !m.delayed[due].due.After(now) {
+		m.spectate(m.delayed[due].msg, m.delayed[due].out)
+		due++
+	}
+	if due > 0 {
+		m.delayed = append(m.delayed[:0], m.delayed[due:]...)
+	}
+}
+
+// spectate queues a broadcast for every spectator. Snapshots only go to
+// those whose send rate says it is their turn, until the game is over.
+func (m *match) spectate(msg interface{}, out outboundMessage) {
+	var state *StateMessage
+	switch msg := msg.(type) {
+	case *StartMessage:
+		m.watching = true
+	case *EndMessage:
+		m.watching = false
+	case *StateMessage:
+		state = msg
+	}
+
+	for client := range m.spectators {
+		if state != nil && !client.sendRate.due() && !state.GameOver {
+			continue
+		}
+		client.enqueue(out)
+	}
+}
+
+// dismissSpectators tells spectators the room is closing once the last
+// player has left for good. Anything still held back for them is sent at
+// once. A game that ended has sent them its end message, and one that
+// never started gets one here.
+func (m *match) dismissSpectators() {
+	for _, d := range m.delayed {
+		m.spectate(d.msg, d.out)
+	}
+	m.delayed = nil
+	if m.game.IsGameOver() {
+		return
+	}
+
+	end := CreateEndMessage(0, game.Scores{}, 0, nil, EndReasonAbandoned)
+	out, err := newOutboundMessage(end)
+	if err != nil {
+		m.logf("Error encoding message: %v", err)
+		return
+	}
+	m.spectate(end, out)
+}
+
+// announceShutdown tells every client the server is shutting down, ending
+// the game if one is running. Spectators are told at once, as nothing held
+// back for them would be sent anyway.
+func (m *match) announceShutdown() {
+	winner, gameTime := 0, int64(0)
+	if m.started {
+		m.game.End(0)
+		winner = m.game.GetWinner()
+		gameTime = m.game.GetGameTime().Milliseconds()
+		m.logf("Game ended (%s)", EndReasonShutdown)
+	}
+	m.started = false
+
+	out, err := newOutboundMessage(CreateEndMessage(
+		winner,
+		m.game.GetScore(),
+		gameTime,
+		m.game.GetBotSubstitutes(),
+		EndReasonShutdown,
+	))
+	if err != nil {
+		m.logf("Error encoding message: %v", err)
+		return
+	}
+	for _, client := range m.clients {
+		client.enqueue(out)
+	}
+	for client := range m.spectators {
+		client.enqueue(out)
+	}
+}
+
+// shutdown lets go of every client when the match stops. Their queues are
+// closed, so each connection is closed once what is queued for it has been
+// written.
+func (m *match) shutdown() {
+	for playerID, client := range m.clients {
+		client.queue.close()
+		delete(m.clients, playerID)
+	}
+	m.away = make(map[int]time.Time)
+	for client := range m.spectators {
+		client.queue.close()
+		delete(m.spectators, client)
+	}
+	m.delayed = nil
+	m.started = false
+	m.game.Stop()
+}
+
+// uniqueName returns the name a client asked for, or fallback if it asked
+// for none, with a number added if someone in the room already goes by it
+func (m *match) uniqueName(name, fallback string) string {
+	if name == "" {
+		name = fallback
+	}
+	taken := func(name string) bool {
+		for _, other := range m.names {
+			if strings.EqualFold(other, name) {
+				return true
+			}
+		}
+		for client := range m.spectators {
+			if strings.EqualFold(client.playerName, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	unique := name
+	for n := 2; taken(unique); n++ {
+		suffix := " " + strconv.Itoa(n)
+		base := []rune(name)
+		if len(base)+len([]rune(suffix)) > maxPlayerNameLength {
+			base = base[:maxPlayerNameLength-len(suffix)]
+		}
+		unique = string(base) + suffix
+	}
+	return unique
+}
+
+// sendRoster tells everyone in the room who is in it. Spectators get it at
+// once, as it says nothing about the game.
+func (m *match) sendRoster() {
+	var entries []RosterEntry
+	for _, playerID := range []int{1, 2} {
+		if name, ok := m.names[playerID]; ok {
+			_, away := m.away[playerID]
+			entries = append(entries, RosterEntry{PlayerID: playerID, Name: name, Role: RolePlayer, Away: away})
+		}
+	}
+	var watching []RosterEntry
+	for client := range m.spectators {
+		watching = append(watching, RosterEntry{Name: client.playerName, Role: RoleSpectator})
+	}
+	sort.Slice(watching, func(i, j int) bool { return watching[i].Name < watching[j].Name })
+	entries = append(entries, watching...)
+
+	out, err := newOutboundMessage(CreateRosterMessage(entries))
+	if err != nil {
+		m.logf("Error encoding message: %v", err)
+		return
+	}
+	for _, client := range m.clients {
+		client.enqueue(out)
+	}
+	for client := range m.spectators {
+		client.enqueue(out)
+	}
+}
+
+// newResumeToken returns an unguessable token for a seat in the given room.
+// The room ID comes first so the server knows which room to ask.
+func newResumeToken(roomID string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate resume token: %v", err)
+	}
+	return roomID + "." + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,195 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+)
+
+// QueuePolicy decides what happens when a client's outbound queue is full
+type QueuePolicy int
+
+const (
+	// QueuePolicyDropState discards the oldest queued state snapshot to
+	// make room. Control messages (join, start, end, ping) are never
+	// dropped. A newer snapshot makes an older one useless anyway.
+	QueuePolicyDropState QueuePolicy = iota
+
+	// QueuePolicyDisconnect disconnects a client that cannot keep up
+	QueuePolicyDisconnect
+)
+
+// String returns the flag name of the policy
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueuePolicyDropState:
+		return "drop"
+	case QueuePolicyDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseQueuePolicy parses a policy name as returned by QueuePolicy.String
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	switch name {
+	case "drop":
+		return QueuePolicyDropState, nil
+	case "disconnect":
+		return QueuePolicyDisconnect, nil
+	default:
+		return 0, fmt.Errorf("unknown queue policy %q", name)
+	}
+}
+
+// QueueStats describes a client's outbound queue
+type QueueStats struct {
+	Depth   int    // Messages currently waiting to be written
+	Dropped uint64 // State snapshots dropped because the queue was full
+}
+
+// outboundMessage is an encoded message waiting to be written. data
+// holds the JSON encoding; writers that have switched to binary frames
+// encode msg themselves.
+type outboundMessage struct {
+	msg         interface{}
+	data        []byte
+	droppable   bool // State snapshots may be dropped; control messages may not
+	closeAfter  bool // The connection closes once this message is written
+	startBinary bool // Messages after this one are written as binary frames
+}
+
+// newOutboundMessage encodes a message for sending. Only state snapshots
+// may be dropped when a queue is full: the next one replaces them. Deltas
+// are against snapshots the client acknowledged, so they can go too.
+func newOutboundMessage(msg interface{}) (outboundMessage, error) {
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		return outboundMessage{}, err
+	}
+	droppable := false
+	switch msg.(type) {
+	case *StateMessage, *DeltaMessage:
+		droppable = true
+	}
+	return outboundMessage{msg: msg, data: append(data, '\n'), droppable: droppable}, nil
+}
+
+// outQueue is a bounded queue of messages for a single client's writer
+// goroutine. Pushing never blocks, so a slow client cannot stall whoever is
+// sending to it.
+type outQueue struct {
+	mu      sync.Mutex
+	items   []outboundMessage
+	limit   int
+	policy  QueuePolicy
+	closed  bool
+	ready   chan struct{} // signalled when items are added or the queue closes
+	dropped uint64
+}
+
+// DefaultQueueSize is how many outbound messages each client may have
+// waiting unless configured otherwise
+const DefaultQueueSize = 64
+
+// newOutQueue creates an empty queue holding up to limit messages
+func newOutQueue(limit int, policy QueuePolicy) *outQueue {
+	return &outQueue{
+		items:  make([]outboundMessage, 0, limit),
+		limit:  limit,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a message. It returns false if the queue is full and the
+// policy says the client should be disconnected.
+func (q *outQueue) push(msg outboundMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return true
+	}
+
+	if len(q.items) >= q.limit {
+		if q.policy == QueuePolicyDisconnect {
+			return false
+		}
+		if !q.dropOldestState() {
+			if msg.droppable {
+				q.dropped++
+				return true
+			}
+			// Only control messages are queued. Let them past the limit,
+			// but a client this far behind is not coming back.
+			if len(q.items) >= 2*q.limit {
+				return false
+			}
+		}
+	}
+
+	q.items = append(q.items, msg)
+	q.signal()
+	return true
+}
+
+// dropOldestState removes the oldest droppable message and reports whether
+// there was one. Callers hold q.mu.
+func (q *outQueue) dropOldestState() bool {
+	for i, item := range q.items {
+		if item.droppable {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+// take waits for queued messages and removes them all from the queue. It
+// returns false once the queue has been closed and drained.
+func (q *outQueue) take() ([]outboundMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			items := q.items
+			q.items = make([]outboundMessage, 0, q.limit)
+			q.mu.Unlock()
+			return items, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return nil, false
+		}
+		q.mu.Unlock()
+
+		<-q.ready
+	}
+}
+
+// close stops the queue. Messages already queued are still handed out.
+func (q *outQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// signal wakes the writer without blocking. Callers hold q.mu.
+func (q *outQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// stats returns the current depth and drop count
+func (q *outQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Depth:   len(q.items),
+		Dropped: q.dropped,
+	}
+}
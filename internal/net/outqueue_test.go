@@ -0,0 +1,144 @@
+package net
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queued describes queued messages for comparing: s and d for snapshots
+// and deltas, p for pings, each with its number
+func queued(items []outboundMessage) string {
+	var names []string
+	for _, item := range items {
+		var msg struct {
+			Type     MessageType `json:"type"`
+			ID       uint32      `json:"id"`
+			Tick     uint32      `json:"tick"`
+			GameTime int64       `json:"gameTime"`
+		}
+		DecodeMessage(item.data, &msg)
+		switch msg.Type {
+		case MessageTypeState:
+			names = append(names, fmt.Sprintf("s%d", msg.GameTime))
+		case MessageTypeDelta:
+			names = append(names, fmt.Sprintf("d%d", msg.Tick))
+		case MessageTypePing:
+			names = append(names, fmt.Sprintf("p%d", msg.ID))
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// TestOutQueuePolicies checks what a full queue does under each policy:
+// dropping the stalest snapshot, dropping a new one when only reliable
+// messages are queued, letting reliable messages past the limit up to a
+// point, or giving up on the client
+func TestOutQueuePolicies(t *testing.T) {
+	state := func(n int64) interface{} { return &StateMessage{Type: MessageTypeState, GameTime: n} }
+	delta := func(tick uint32) interface{} { return &DeltaMessage{Type: MessageTypeDelta, Tick: tick} }
+	ping := func(id uint32) interface{} { return CreatePingMessage(id, time.Now()) }
+
+	for _, tc := range []struct {
+		name        string
+		policy      QueuePolicy
+		msgs        []interface{}
+		wantOK      bool // whether the last push kept the client
+		wantQueued  string
+		wantDropped uint64
+	}{
+		{
+			"room to spare", QueuePolicyDropState,
+			[]interface{}{state(1), ping(1), delta(2)},
+			true, "s1 p1 d2", 0,
+		},
+		{
+			"stalest snapshot dropped", QueuePolicyDropState,
+			[]interface{}{ping(1), state(1), delta(2), state(3), ping(2)},
+			true, "p1 d2 s3 p2", 1,
+		},
+		{
+			"new snapshot dropped behind reliable messages", QueuePolicyDropState,
+			[]interface{}{ping(1), ping(2), ping(3), ping(4), state(1)},
+			true, "p1 p2 p3 p4", 1,
+		},
+		{
+			"reliable messages past the limit", QueuePolicyDropState,
+			[]interface{}{ping(1), ping(2), ping(3), ping(4), ping(5), ping(6), ping(7), ping(8)},
+			true, "p1 p2 p3 p4 p5 p6 p7 p8", 0,
+		},
+		{
+			"too far behind", QueuePolicyDropState,
+			[]interface{}{ping(1), ping(2), ping(3), ping(4), ping(5), ping(6), ping(7), ping(8), ping(9)},
+			false, "p1 p2 p3 p4 p5 p6 p7 p8", 0,
+		},
+		{
+			"disconnect when full", QueuePolicyDisconnect,
+			[]interface{}{state(1), state(2), state(3), state(4), state(5)},
+			false, "s1 s2 s3 s4", 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newOutQueue(4, tc.policy)
+			ok := true
+			for _, msg := range tc.msgs {
+				out, err := newOutboundMessage(msg)
+				if err != nil {
+					t.Fatalf("failed to encode %T: %v", msg, err)
+				}
+				ok = q.push(out)
+			}
+			if ok != tc.wantOK {
+				t.Errorf("expected the last push to return %v", tc.wantOK)
+			}
+			stats := q.stats()
+			if stats.Dropped != tc.wantDropped {
+				t.Errorf("expected %d dropped, got %d", tc.wantDropped, stats.Dropped)
+			}
+			items, _ := q.take()
+			if got := queued(items); got != tc.wantQueued || stats.Depth != len(items) {
+				t.Errorf("expected %q queued, got %q at depth %d", tc.wantQueued, got, stats.Depth)
+			}
+		})
+	}
+}
+
+// TestOutQueueClose checks that closing a queue still hands out what was
+// queued, then tells the writer it is done
+func TestOutQueueClose(t *testing.T) {
+	q := newOutQueue(4, QueuePolicyDropState)
+	out, _ := newOutboundMessage(CreatePingMessage(1, time.Now()))
+	q.push(out)
+
+	done := make(chan string)
+	go func() {
+		var got []string
+		for {
+			items, ok := q.take()
+			if !ok {
+				done <- strings.Join(got, " ")
+				return
+			}
+			got = append(got, queued(items))
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	out, _ = newOutboundMessage(CreatePingMessage(2, time.Now()))
+	q.push(out)
+	q.close()
+	out, _ = newOutboundMessage(CreatePingMessage(3, time.Now()))
+	if !q.push(out) {
+		t.Fatal("expected a push after close to be ignored, not fail")
+	}
+
+	select {
+	case got := <-done:
+		if got != "p1 p2" {
+			t.Fatalf("expected p1 and p2 before the queue closed, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take did not return after close")
+	}
+}
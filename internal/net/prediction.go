@@ -0,0 +1,80 @@
+package net
+
+import "network-pong-battle/internal/game"
+
+// maxPendingInputs bounds the inputs kept for replay. If the server stops
+// acknowledging input for this long the oldest inputs are forgotten.
+const maxPendingInputs = 256
+
+// predictor moves the local player's paddles as soon as input is sent and
+// reconciles them against authoritative server state. Inputs the server has
+// not acknowledged yet are replayed on top of each state it sends.
+type predictor struct {
+	playerID  int
+	fieldSize int
+	paddles   []game.Paddle
+	pending   []game.Input
+}
+
+// newPredictor creates a predictor for the given player
+func newPredictor(playerID, fieldSize int) *predictor {
+	return &predictor{
+		playerID:  playerID,
+		fieldSize: fieldSize,
+	}
+}
+
+// apply predicts the effect of an input the client has just sent
+func (p *predictor) apply(input game.Input) {
+	p.pending = append(p.pending, input)
+	if len(p.pending) > maxPendingInputs {
+		p.pending = p.pending[len(p.pending)-maxPendingInputs:]
+	}
+
+	for i := range p.paddles {
+		p.paddles[i].Move(input.Horizontal, input.Vertical, p.fieldSize)
+	}
+}
+
+// reconcile rebases the prediction on the server's paddles. Inputs up to
+// and including ack have been applied by the server and are dropped; the
+// rest are replayed in order.
+func (p *predictor) reconcile(serverPaddles []game.Paddle, ack uint32) {
+	p.paddles = p.paddles[:0]
+	for _, paddle := range serverPaddles {
+		if paddle.PlayerID == p.playerID {
+			p.paddles = append(p.paddles, paddle)
+		}
+	}
+
+	unacked := p.pending[:0]
+	for _, input := range p.pending {
+		if input.Seq > ack {
+			unacked = append(unacked, input)
+		}
+	}
+	p.pending = unacked
+
+	for _, input := range p.pending {
+		for i := range p.paddles {
+			p.paddles[i].Move(input.Horizontal, input.Vertical, p.fieldSize)
+		}
+	}
+}
+
+// overlay replaces the local player's paddles in paddles with the predicted
+// ones, leaving everyone else's as the server sent them
+func (p *predictor) overlay(paddles []game.Paddle) []game.Paddle {
+	result := append([]game.Paddle{}, paddles...)
+	for i := range result {
+		if result[i].PlayerID != p.playerID {
+			continue
+		}
+		for _, predicted := range p.paddles {
+			if predicted.PaddleID == result[i].PaddleID {
+				result[i] = predicted
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package net
+
+import (
+	"testing"
+
+	"network-pong-battle/internal/game"
+)
+
+// TestPredictorReconcile checks that reconciling rebases the prediction on
+// the server's paddles, prunes the inputs the server has acknowledged and
+// replays the rest on top
+func TestPredictorReconcile(t *testing.T) {
+	const fieldSize = 800
+	// Player 1 holds down and right for three inputs
+	inputs := []game.Input{
+		{Seq: 1, Vertical: 1, Horizontal: 1},
+		{Seq: 2, Vertical: 1, Horizontal: 1},
+		{Seq: 3, Vertical: 1, Horizontal: 1},
+	}
+	paddles := func(y, x float64) []game.Paddle {
+		return []game.Paddle{
+			game.NewPaddle(1, 1, 0, y, 10, 100),
+			game.NewPaddle(1, 2, x, 0, 100, 10),
+			game.NewPaddle(2, 1, 790, 300, 10, 100),
+		}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		server      []game.Paddle
+		ack         uint32
+		wantY       float64 // of the vertical paddle
+		wantX       float64 // of the horizontal paddle
+		wantPending []uint32
+	}{
+		{"nothing acknowledged", paddles(100, 100), 0, 115, 115, []uint32{1, 2, 3}},
+		{"correction replays unacked inputs", paddles(200, 50), 1, 210, 60, []uint32{2, 3}},
+		{"everything acknowledged", paddles(200, 50), 3, 200, 50, nil},
+		{"later ack prunes more", paddles(200, 50), 2, 205, 55, []uint32{3}},
+		{"replay stops at the edge", paddles(fieldSize-105, fieldSize-105), 1, fieldSize - 100, fieldSize - 100, []uint32{2, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPredictor(1, fieldSize)
+			p.reconcile(paddles(100, 100), 0)
+			for _, input := range inputs {
+				p.apply(input)
+			}
+
+			p.reconcile(tc.server, tc.ack)
+			if len(p.paddles) != 2 {
+				t.Fatalf("expected only player 1's two paddles, got %+v", p.paddles)
+			}
+			if p.paddles[0].Y != tc.wantY || p.paddles[1].X != tc.wantX {
+				t.Errorf("expected paddles at y %v and x %v, got %v and %v",
+					tc.wantY, tc.wantX, p.paddles[0].Y, p.paddles[1].X)
+			}
+			var pending []uint32
+			for _, input := range p.pending {
+				pending = append(pending, input.Seq)
+			}
+			if len(pending) != len(tc.wantPending) {
+				t.Fatalf("expected inputs %v still pending, got %v", tc.wantPending, pending)
+			}
+			for i := range pending {
+				if pending[i] != tc.wantPending[i] {
+					t.Fatalf("expected inputs %v still pending, got %v", tc.wantPending, pending)
+				}
+			}
+
+			// The prediction replaces only player 1's paddles
+			shown := p.overlay(tc.server)
+			if shown[0].Y != tc.wantY || shown[1].X != tc.wantX || shown[2] != tc.server[2] {
+				t.Errorf("expected the prediction overlaid on player 1's paddles only, got %+v", shown)
+			}
+		})
+	}
+}
@@ -3,6 +3,35 @@ package net
 import (
 	"encoding/json"
 	"network-pong-battle/internal/game"
+	"time"
+)
+
+// Protocol versions. Version 1 is the original protocol, spoken by clients
+// that never send hello; the server still accepts it. Version 2 starts with
+// a hello/welcome handshake.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Roles a client can ask for in its hello
+const (
+	RolePlayer    = "player"
+	RoleSpectator = "spectator"
+)
+
+// Optional protocol features a client can offer in its hello. The server
+// answers with the ones both sides support. When both sides have
+// FeatureEncodingBinary, every message after the welcome is sent as a
+// binary frame instead of a line of JSON. FeatureDeltaSnapshots lets the
+// server send players DeltaMessages between keyframes. FeatureTransportUDP
+// moves snapshots, inputs and acks to UDP datagrams, while everything else
+// stays on the TCP connection.
+const (
+	FeatureEncodingJSON   = "encoding:json"
+	FeatureEncodingBinary = "encoding:binary"
+	FeatureDeltaSnapshots = "snapshots:delta"
+	FeatureTransportUDP   = "transport:udp"
 )
 
 // MessageType represents the type of network message
@@ -14,46 +43,314 @@ const (
 	MessageTypeJoin  MessageType = "join"
 	MessageTypeStart MessageType = "start"
 	MessageTypeEnd   MessageType = "end"
+	MessageTypePing  MessageType = "ping"
+	MessageTypePong  MessageType = "pong"
+
+	MessageTypeCreateRoom  MessageType = "create_room"
+	MessageTypeListRooms   MessageType = "list_rooms"
+	MessageTypeRoomList    MessageType = "room_list"
+	MessageTypeJoinRoom    MessageType = "join_room"
+	MessageTypeRoomCreated MessageType = "room_created"
+	MessageTypeResume      MessageType = "resume"
+	MessageTypePaused      MessageType = "paused"
+	MessageTypeRoster      MessageType = "roster"
+
+	MessageTypeHello   MessageType = "hello"
+	MessageTypeWelcome MessageType = "welcome"
+	MessageTypeError   MessageType = "error"
+
+	MessageTypeDelta           MessageType = "delta"
+	MessageTypeAck             MessageType = "ack"
+	MessageTypeKeyframeRequest MessageType = "keyframe_request"
+	MessageTypeUDPHello        MessageType = "udp_hello"
+)
+
+// Error codes, sent in ErrorMessage.Code
+const (
+	ErrorRoomFull        = "room_full"
+	ErrorVersionMismatch = "version_mismatch"
+	ErrorBadInput        = "bad_input" // a message that could not be decoded or made no sense
+	ErrorBanned          = "banned"
+	ErrorAuthFailed      = "auth_failed" // wrong room password
+	ErrorRateLimited     = "rate_limited"
+	ErrorUnknownRoom     = "unknown_room"
+	ErrorAlreadyInRoom   = "already_in_room"
+	ErrorInvalidSettings = "invalid_settings"
+	ErrorTooManyRooms    = "too_many_rooms"
+	ErrorSpectatorsFull  = "spectators_full"
+	ErrorInvalidToken    = "invalid_token"
+	ErrorInvalidRole     = "invalid_role"
+	ErrorMessageTooLarge = "message_too_large" // a message over the server's size limit
+	ErrorInvalidName     = "invalid_name"
 )
 
-// InputMessage represents player input sent from client to server
+// Reasons a game can end, sent in EndMessage.Reason
+const (
+	EndReasonScore     = "score"     // a player reached the target score
+	EndReasonTime      = "time"      // the time limit ran out
+	EndReasonForfeit   = "forfeit"   // the winner's opponent left
+	EndReasonAbandoned = "abandoned" // players left and nobody was awarded the win
+	EndReasonAdmin     = "admin"     // the server ended the game
+	EndReasonShutdown  = "shutdown"  // the server is shutting down
+)
+
+// InputMessage represents one tick of movement intent sent from client to
+// server. The server moves the sender's paddles; it never trusts positions.
 type InputMessage struct {
-	Type      MessageType `json:"type"`
-	PlayerID  int         `json:"playerId"`
-	Paddle1Y  float64     `json:"paddle1Y,omitempty"`
-	Paddle2X  float64     `json:"paddle2X,omitempty"`
+	Type       MessageType `json:"type"`
+	PlayerID   int         `json:"playerId"`
+	Seq        uint32      `json:"seq"`
+	Vertical   float64     `json:"vertical,omitempty"`   // -1 up to 1 down
+	Horizontal float64     `json:"horizontal,omitempty"` // -1 left to 1 right
 }
 
-// StateMessage represents the complete game state sent from server to clients
+// StateMessage represents the complete game state sent from server to clients.
+// Tick numbers the snapshots of a room; clients that get deltas acknowledge
+// snapshots by their tick.
 type StateMessage struct {
-	Type      MessageType       `json:"type"`
-	Balls     []game.Ball       `json:"balls"`
-	Paddles   []game.Paddle     `json:"paddles"`
-	GameOver  bool              `json:"gameOver"`
-	Winner    int               `json:"winner"`
-	GameTime  int64             `json:"gameTime"`  // in milliseconds
-	Remaining int64              `json:"remaining"` // remaining time in milliseconds
+	Type       MessageType    `json:"type"`
+	Tick       uint32         `json:"tick,omitempty"`
+	Balls      []game.Ball    `json:"balls"`
+	Paddles    []game.Paddle  `json:"paddles"`
+	Scores     game.Scores    `json:"scores"`
+	InputAcks  map[int]uint32 `json:"inputAcks,omitempty"` // last input applied per player
+	GameOver   bool           `json:"gameOver"`
+	Winner     int            `json:"winner"`
+	GameTime   int64          `json:"gameTime"`   // elapsed time in milliseconds
+	Remaining  int64          `json:"remaining"`  // remaining time in milliseconds
+	ServerTime int64          `json:"serverTime"` // server clock when sent, Unix milliseconds
 }
 
-// JoinMessage represents a player joining the game
+// JoinMessage represents a player joining the game. Spectators are told
+// they joined with PlayerID 0 and Spectator set. Players get a resume
+// token they can send in a ResumeMessage to take their seat back after
+// losing the connection.
 type JoinMessage struct {
-	Type      MessageType `json:"type"`
-	PlayerID  int         `json:"playerId"`
-	PlayerName string     `json:"playerName"`
+	Type        MessageType `json:"type"`
+	RoomID      string      `json:"roomId"`
+	PlayerID    int         `json:"playerId"`
+	PlayerName  string      `json:"playerName"`
+	Spectator   bool        `json:"spectator,omitempty"`
+	ResumeToken string      `json:"resumeToken,omitempty"`
+	TickRate    int         `json:"tickRate,omitempty"` // ticks per second, which snapshot ticks count
 }
 
 // StartMessage represents the game starting
 type StartMessage struct {
-	Type      MessageType `json:"type"`
-	Settings  game.GameSettings `json:"settings"`
+	Type     MessageType       `json:"type"`
+	Settings game.GameSettings `json:"settings"`
 }
 
 // EndMessage represents the game ending
 type EndMessage struct {
-	Type      MessageType `json:"type"`
-	Winner    int         `json:"winner"`
+	Type        MessageType `json:"type"`
+	Winner      int         `json:"winner"`
 	FinalScores game.Scores `json:"finalScores"`
-	GameTime  int64       `json:"gameTime"`
+	GameTime    int64       `json:"gameTime"`
+	BotPlayers  []int       `json:"botPlayers,omitempty"` // players a bot substituted for
+	Reason      string      `json:"reason"`               // one of the EndReason constants
+}
+
+// PingMessage asks the peer to answer with a pong. Either side may send it.
+type PingMessage struct {
+	Type   MessageType `json:"type"`
+	ID     uint32      `json:"id"`
+	SentAt int64       `json:"sentAt"` // sender clock, Unix microseconds
+}
+
+// PongMessage answers a ping, echoing its send time and adding the
+// responder's receive and send times so the pinger can estimate the offset
+// between the two clocks
+type PongMessage struct {
+	Type       MessageType `json:"type"`
+	ID         uint32      `json:"id"`
+	PingSentAt int64       `json:"pingSentAt"` // pinger clock, Unix microseconds
+	ReceivedAt int64       `json:"receivedAt"` // responder clock, Unix microseconds
+	SentAt     int64       `json:"sentAt"`     // responder clock, Unix microseconds
+}
+
+// RoomSettings are the game settings a client may choose when creating a
+// room. Zero fields keep the server's default.
+type RoomSettings struct {
+	BallCount   int `json:"ballCount,omitempty"`
+	TargetScore int `json:"targetScore,omitempty"`
+	TimeLimit   int `json:"timeLimit,omitempty"` // in seconds
+}
+
+// RoomInfo describes one room in a room list
+type RoomInfo struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Players    int          `json:"players"`
+	MaxPlayers int          `json:"maxPlayers"`
+	Started    bool         `json:"started"`
+	Locked     bool         `json:"locked"` // a password is needed to join
+	Spectators int          `json:"spectators"`
+	Settings   RoomSettings `json:"settings"`
+}
+
+// CreateRoomMessage asks the server to create a room and seat the sender
+// in it. Private rooms are left out of room lists and can only be joined
+// with their join code.
+type CreateRoomMessage struct {
+	Type       MessageType  `json:"type"`
+	Name       string       `json:"name"`
+	Private    bool         `json:"private,omitempty"`
+	Password   string       `json:"password,omitempty"`
+	Settings   RoomSettings `json:"settings"`
+	PlayerName string       `json:"playerName,omitempty"` // the creator's name, instead of the one in their hello
+}
+
+// RoomCreatedMessage tells the creator of a room how others can join it
+type RoomCreatedMessage struct {
+	Type   MessageType `json:"type"`
+	RoomID string      `json:"roomId"`
+	Name   string      `json:"name"`
+	Code   string      `json:"code"` // short join code to share with others
+}
+
+// ListRoomsMessage asks the server for its rooms
+type ListRoomsMessage struct {
+	Type MessageType `json:"type"`
+}
+
+// RoomListMessage answers a ListRoomsMessage
+type RoomListMessage struct {
+	Type  MessageType `json:"type"`
+	Rooms []RoomInfo  `json:"rooms"`
+}
+
+// JoinRoomMessage asks the server to seat the sender in a room, named by
+// its ID or its join code. With neither, the sender joins any public room
+// with a free seat, and one is created if needed. Spectators with neither
+// watch a public room, preferring one whose game has started.
+type JoinRoomMessage struct {
+	Type       MessageType `json:"type"`
+	RoomID     string      `json:"roomId,omitempty"`
+	Code       string      `json:"code,omitempty"`
+	Password   string      `json:"password,omitempty"`
+	Spectate   bool        `json:"spectate,omitempty"`   // watch instead of taking a seat
+	PlayerName string      `json:"playerName,omitempty"` // instead of the name in the hello
+}
+
+// ResumeMessage asks the server for the seat a resume token was issued
+// for. The server answers with a join message, then start and state
+// messages if the game is running, or with an ErrorMessage.
+type ResumeMessage struct {
+	Type  MessageType `json:"type"`
+	Token string      `json:"token"`
+}
+
+// PausedMessage tells the players in a room that the game has paused to
+// wait for a player who lost their connection, or that it carries on
+type PausedMessage struct {
+	Type     MessageType `json:"type"`
+	Paused   bool        `json:"paused"`
+	PlayerID int         `json:"playerId"`        // the player being waited for
+	Grace    int64       `json:"grace,omitempty"` // how long their seat is held, in milliseconds
+}
+
+// RosterEntry describes someone in a room
+type RosterEntry struct {
+	PlayerID int    `json:"playerId,omitempty"` // 0 for spectators
+	Name     string `json:"name"`
+	Role     string `json:"role"`           // RolePlayer or RoleSpectator
+	Away     bool   `json:"away,omitempty"` // lost their connection; their seat is held
+}
+
+// RosterMessage lists everyone in a room, players first by ID and then
+// spectators by name. It is sent to everyone in the room whenever someone
+// joins, leaves or loses their connection.
+type RosterMessage struct {
+	Type    MessageType   `json:"type"`
+	Entries []RosterEntry `json:"entries"`
+}
+
+// HelloMessage is the first message a client sends. It says which protocol
+// version the client speaks, who it is and what it can do.
+type HelloMessage struct {
+	Type     MessageType `json:"type"`
+	Version  int         `json:"version"`
+	Name     string      `json:"name,omitempty"`
+	Role     string      `json:"role,omitempty"`     // RolePlayer or RoleSpectator
+	Features []string    `json:"features,omitempty"` // Feature constants the client supports
+}
+
+// WelcomeMessage accepts a hello with the protocol version and features
+// both sides will use. If FeatureTransportUDP was agreed it also says
+// where to send datagrams, and the token that ties them to this client.
+type WelcomeMessage struct {
+	Type     MessageType `json:"type"`
+	Version  int         `json:"version"`
+	Features []string    `json:"features"`
+	UDPPort  int         `json:"udpPort,omitempty"`
+	UDPToken string      `json:"udpToken,omitempty"`
+}
+
+// ErrorMessage tells a client a request failed. After a fatal error the
+// server closes the connection; otherwise the client may carry on.
+type ErrorMessage struct {
+	Type    MessageType `json:"type"`
+	Code    string      `json:"code"`    // one of the Error constants
+	Message string      `json:"message"` // human readable explanation
+	Fatal   bool        `json:"fatal"`
+}
+
+// DeltaMessage is a state snapshot sent as its changes from Base, an
+// earlier snapshot the client acknowledged. Balls and paddles are listed
+// by their index in the base snapshot, and only if they moved. Scores and
+// input acks are only included if they changed. A client that no longer
+// has the base snapshot asks for a keyframe with a KeyframeRequestMessage.
+type DeltaMessage struct {
+	Type       MessageType    `json:"type"`
+	Tick       uint32         `json:"tick"`
+	Base       uint32         `json:"base"`
+	Balls      []BallDelta    `json:"balls,omitempty"`
+	Paddles    []PaddleDelta  `json:"paddles,omitempty"`
+	Scores     *game.Scores   `json:"scores,omitempty"`
+	InputAcks  map[int]uint32 `json:"inputAcks,omitempty"`
+	GameOver   bool           `json:"gameOver,omitempty"`
+	Winner     int            `json:"winner,omitempty"`
+	GameTime   int64          `json:"gameTime"`
+	Remaining  int64          `json:"remaining"`
+	ServerTime int64          `json:"serverTime"`
+}
+
+// BallDelta is where a ball is and where it is heading
+type BallDelta struct {
+	Index int     `json:"i"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	DX    float64 `json:"dx"`
+	DY    float64 `json:"dy"`
+}
+
+// PaddleDelta is where a paddle is
+type PaddleDelta struct {
+	Index int     `json:"i"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+}
+
+// AckMessage tells the server the latest snapshot a client has, which it
+// may send deltas against
+type AckMessage struct {
+	Type MessageType `json:"type"`
+	Tick uint32      `json:"tick"`
+}
+
+// KeyframeRequestMessage asks the server for a full snapshot, after the
+// client got a delta against a snapshot it does not have
+type KeyframeRequestMessage struct {
+	Type MessageType `json:"type"`
+}
+
+// UDPHelloMessage is the first datagram a client sends, carrying the token
+// from its welcome. The server sends it back once it will use UDP for the
+// client.
+type UDPHelloMessage struct {
+	Type  MessageType `json:"type"`
+	Token string      `json:"token"`
 }
 
 // EncodeMessage encodes a message to JSON bytes
@@ -67,33 +364,45 @@ func DecodeMessage(data []byte, msg interface{}) error {
 }
 
 // CreateInputMessage creates an input message for a player
-func CreateInputMessage(playerID int, paddle1Y, paddle2X float64) *InputMessage {
+func CreateInputMessage(playerID int, input game.Input) *InputMessage {
 	return &InputMessage{
-		Type:     MessageTypeInput,
-		PlayerID: playerID,
-		Paddle1Y: paddle1Y,
-		Paddle2X: paddle2X,
+		Type:       MessageTypeInput,
+		PlayerID:   playerID,
+		Seq:        input.Seq,
+		Vertical:   input.Vertical,
+		Horizontal: input.Horizontal,
 	}
 }
 
-// CreateStateMessage creates a state message from game state
-func CreateStateMessage(state game.GameState) *StateMessage {
+// CreateStateMessage creates a state message from game state and the last
+// input applied for each player
+func CreateStateMessage(state game.GameState, inputAcks map[int]uint32) *StateMessage {
+	elapsed := time.Since(state.StartTime)
+	remaining := state.Settings.TimeLimit - elapsed
+	if remaining < 0 {
+		remaining = 0
+	}
+
 	return &StateMessage{
-		Type:     MessageTypeState,
-		Balls:    state.Balls,
-		Paddles:  state.Paddles,
-		GameOver: state.GameOver,
-		Winner:   state.Winner,
-		GameTime: int64(state.StartTime.UnixMilli()),
-		Remaining: int64(state.Settings.TimeLimit.Milliseconds()),
+		Type:       MessageTypeState,
+		Balls:      state.Balls,
+		Paddles:    state.Paddles,
+		Scores:     state.Scores,
+		InputAcks:  inputAcks,
+		GameOver:   state.GameOver,
+		Winner:     state.Winner,
+		GameTime:   elapsed.Milliseconds(),
+		Remaining:  remaining.Milliseconds(),
+		ServerTime: time.Now().UnixMilli(),
 	}
 }
 
 // CreateJoinMessage creates a join message
-func CreateJoinMessage(playerID int, playerName string) *JoinMessage {
+func CreateJoinMessage(roomID string, playerID int, playerName string) *JoinMessage {
 	return &JoinMessage{
-		Type:      MessageTypeJoin,
-		PlayerID:  playerID,
+		Type:       MessageTypeJoin,
+		RoomID:     roomID,
+		PlayerID:   playerID,
 		PlayerName: playerName,
 	}
 }
@@ -107,11 +416,157 @@ func CreateStartMessage(settings game.GameSettings) *StartMessage {
 }
 
 // CreateEndMessage creates an end message
-func CreateEndMessage(winner int, scores game.Scores, gameTime int64) *EndMessage {
+func CreateEndMessage(winner int, scores game.Scores, gameTime int64, botPlayers []int, reason string) *EndMessage {
 	return &EndMessage{
 		Type:        MessageTypeEnd,
 		Winner:      winner,
 		FinalScores: scores,
 		GameTime:    gameTime,
+		BotPlayers:  botPlayers,
+		Reason:      reason,
+	}
+}
+
+// CreatePingMessage creates a ping message
+func CreatePingMessage(id uint32, sentAt time.Time) *PingMessage {
+	return &PingMessage{
+		Type:   MessageTypePing,
+		ID:     id,
+		SentAt: sentAt.UnixMicro(),
+	}
+}
+
+// CreatePongMessage creates a pong message answering a ping
+func CreatePongMessage(id uint32, pingSentAt int64, receivedAt, sentAt time.Time) *PongMessage {
+	return &PongMessage{
+		Type:       MessageTypePong,
+		ID:         id,
+		PingSentAt: pingSentAt,
+		ReceivedAt: receivedAt.UnixMicro(),
+		SentAt:     sentAt.UnixMicro(),
+	}
+}
+
+// CreateCreateRoomMessage creates a create_room message
+func CreateCreateRoomMessage(name string, private bool, password string, settings RoomSettings) *CreateRoomMessage {
+	return &CreateRoomMessage{
+		Type:     MessageTypeCreateRoom,
+		Name:     name,
+		Private:  private,
+		Password: password,
+		Settings: settings,
+	}
+}
+
+// CreateRoomCreatedMessage creates a room_created message
+func CreateRoomCreatedMessage(roomID, name, code string) *RoomCreatedMessage {
+	return &RoomCreatedMessage{
+		Type:   MessageTypeRoomCreated,
+		RoomID: roomID,
+		Name:   name,
+		Code:   code,
+	}
+}
+
+// CreateListRoomsMessage creates a list_rooms message
+func CreateListRoomsMessage() *ListRoomsMessage {
+	return &ListRoomsMessage{Type: MessageTypeListRooms}
+}
+
+// CreateRoomListMessage creates a room_list message
+func CreateRoomListMessage(rooms []RoomInfo) *RoomListMessage {
+	return &RoomListMessage{
+		Type:  MessageTypeRoomList,
+		Rooms: rooms,
+	}
+}
+
+// CreateJoinRoomMessage creates a join_room message
+func CreateJoinRoomMessage(roomID, code, password string) *JoinRoomMessage {
+	return &JoinRoomMessage{
+		Type:     MessageTypeJoinRoom,
+		RoomID:   roomID,
+		Code:     code,
+		Password: password,
+	}
+}
+
+// CreateResumeMessage creates a resume message
+func CreateResumeMessage(token string) *ResumeMessage {
+	return &ResumeMessage{
+		Type:  MessageTypeResume,
+		Token: token,
+	}
+}
+
+// CreatePausedMessage creates a paused message
+func CreatePausedMessage(paused bool, playerID int, grace time.Duration) *PausedMessage {
+	return &PausedMessage{
+		Type:     MessageTypePaused,
+		Paused:   paused,
+		PlayerID: playerID,
+		Grace:    grace.Milliseconds(),
+	}
+}
+
+// CreateRosterMessage creates a roster message
+func CreateRosterMessage(entries []RosterEntry) *RosterMessage {
+	return &RosterMessage{
+		Type:    MessageTypeRoster,
+		Entries: entries,
+	}
+}
+
+// CreateHelloMessage creates a hello message for the current protocol
+// version
+func CreateHelloMessage(name, role string, features []string) *HelloMessage {
+	return &HelloMessage{
+		Type:     MessageTypeHello,
+		Version:  ProtocolVersion,
+		Name:     name,
+		Role:     role,
+		Features: features,
+	}
+}
+
+// CreateWelcomeMessage creates a welcome message
+func CreateWelcomeMessage(version int, features []string) *WelcomeMessage {
+	return &WelcomeMessage{
+		Type:     MessageTypeWelcome,
+		Version:  version,
+		Features: features,
+	}
+}
+
+// CreateErrorMessage creates an error message
+func CreateErrorMessage(code, message string, fatal bool) *ErrorMessage {
+	return &ErrorMessage{
+		Type:    MessageTypeError,
+		Code:    code,
+		Message: message,
+		Fatal:   fatal,
+	}
+}
+
+// CreateAckMessage creates an ack message
+func CreateAckMessage(tick uint32) *AckMessage {
+	return &AckMessage{
+		Type: MessageTypeAck,
+		Tick: tick,
+	}
+}
+
+// CreateKeyframeRequestMessage creates a keyframe request message
+func CreateKeyframeRequestMessage() *KeyframeRequestMessage {
+	return &KeyframeRequestMessage{
+		Type: MessageTypeKeyframeRequest,
+	}
+}
+
+// CreateUDPHelloMessage creates a UDP hello message
+func CreateUDPHelloMessage(token string) *UDPHelloMessage {
+	return &UDPHelloMessage{
+		Type:  MessageTypeUDPHello,
+		Token: token,
 	}
 }
@@ -0,0 +1,43 @@
+package net
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestErrorCodes pins the error codes clients may see, so none is renamed
+// or dropped by accident, and checks the README lists each of them. Two
+// codes with the same value would not compile as keys of the map.
+func TestErrorCodes(t *testing.T) {
+	codes := map[string]string{
+		ErrorRoomFull:        "room_full",
+		ErrorVersionMismatch: "version_mismatch",
+		ErrorBadInput:        "bad_input",
+		ErrorBanned:          "banned",
+		ErrorAuthFailed:      "auth_failed",
+		ErrorRateLimited:     "rate_limited",
+		ErrorUnknownRoom:     "unknown_room",
+		ErrorAlreadyInRoom:   "already_in_room",
+		ErrorInvalidSettings: "invalid_settings",
+		ErrorTooManyRooms:    "too_many_rooms",
+		ErrorSpectatorsFull:  "spectators_full",
+		ErrorInvalidToken:    "invalid_token",
+		ErrorInvalidRole:     "invalid_role",
+		ErrorMessageTooLarge: "message_too_large",
+		ErrorInvalidName:     "invalid_name",
+	}
+
+	readme, err := os.ReadFile("../../README.md")
+	if err != nil {
+		t.Fatalf("failed to read the README: %v", err)
+	}
+	for code, want := range codes {
+		if code != want {
+			t.Errorf("expected error code %q, got %q", want, code)
+		}
+		if !strings.Contains(string(readme), "`"+code+"`") {
+			t.Errorf("error code %q is missing from the README", code)
+		}
+	}
+}
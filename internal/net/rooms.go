@@ -0,0 +1,280 @@
+package net
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"network-pong-battle/internal/game"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the settings a client may choose for a room
+const (
+	maxRoomNameLength = 32 // characters; longer names are cut short
+	minBallCount      = 1
+	maxBallCount      = 8
+	minTargetScore    = 1
+	maxTargetScore    = 100
+	minTimeLimit      = 30 * time.Second
+	maxTimeLimit      = time.Hour
+	maxPasswordLength = 64
+)
+
+// Join codes are short and avoid characters that are easy to mix up when
+// read aloud or copied by hand, such as 0/O and 1/I
+const (
+	joinCodeLength   = 6
+	joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// roomManager keeps track of the server's rooms. Each room is a match with
+// its own goroutine; the manager only guards the registry.
+type roomManager struct {
+	mu     sync.Mutex
+	config ServerConfig
+	rooms  map[string]*match
+	codes  map[string]*match
+	nextID int
+	closed bool // set by stopAll, after which no rooms are created
+}
+
+// newRoomManager creates a manager with no rooms
+func newRoomManager(config ServerConfig) *roomManager {
+	return &roomManager{
+		config: config,
+		rooms:  make(map[string]*match),
+		codes:  make(map[string]*match),
+	}
+}
+
+// create creates and starts a room. Rooms close themselves once the last
+// player leaves. The name is trimmed and cut to maxRoomNameLength
+// characters. An empty password leaves the room open to anyone who can
+// find it.
+func (rm *roomManager) create(name string, settings game.GameSettings, private bool, password string) (*match, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.closed {
+		return nil, fmt.Errorf("server is shutting down")
+	}
+	if rm.config.MaxRooms > 0 && len(rm.rooms) >= rm.config.MaxRooms {
+		return nil, fmt.Errorf("server already has %d rooms", len(rm.rooms))
+	}
+	code, err := rm.newCode()
+	if err != nil {
+		return nil, err
+	}
+
+	rm.nextID++
+	id := strconv.Itoa(rm.nextID)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Room " + id
+	}
+	if runes := []rune(name); len(runes) > maxRoomNameLength {
+		name = strings.TrimSpace(string(runes[:maxRoomNameLength]))
+	}
+
+	m := newMatch(id, name, settings, rm.config)
+	m.code = code
+	m.private = private
+	if password != "" {
+		m.passwordHash = hashPassword(password)
+	}
+	m.onClose = rm.remove
+	rm.rooms[id] = m
+	rm.codes[code] = m
+	go m.run()
+
+	return m, nil
+}
+
+// get returns the room with the given ID, or nil
+func (rm *roomManager) get(id string) *match {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.rooms[id]
+}
+
+// byCode returns the room with the given join code, or nil. Codes are not
+// case sensitive.
+func (rm *roomManager) byCode(code string) *match {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.codes[strings.ToUpper(strings.TrimSpace(code))]
+}
+
+// newCode returns a join code no open room is using. Callers hold rm.mu.
+func (rm *roomManager) newCode() (string, error) {
+	buf := make([]byte, joinCodeLength)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to generate join code: %v", err)
+		}
+		for i, b := range buf {
+			buf[i] = joinCodeAlphabet[int(b)%len(joinCodeAlphabet)]
+		}
+		if code := string(buf); rm.codes[code] == nil {
+			return code, nil
+		}
+	}
+}
+
+// open returns a public room without a password that has not started and
+// has a free seat, creating one with default settings if there is none
+func (rm *roomManager) open() (*match, error) {
+	for _, info := range rm.list() {
+		if !info.Started && !info.Locked && info.Players < info.MaxPlayers {
+			if m := rm.get(info.ID); m != nil {
+				return m, nil
+			}
+		}
+	}
+	return rm.create("", game.DefaultSettings(), false, "")
+}
+
+// watchable returns a public room without a password for a spectator,
+// preferring one whose game has started, or nil if there is none
+func (rm *roomManager) watchable() *match {
+	var waiting *match
+	for _, info := range rm.list() {
+		if info.Locked {
+			continue
+		}
+		m := rm.get(info.ID)
+		if m == nil {
+			continue
+		}
+		if info.Started {
+			return m
+		}
+		if waiting == nil {
+			waiting = m
+		}
+	}
+	return waiting
+}
+
+// list describes every public room, ordered by ID
+func (rm *roomManager) list() []RoomInfo {
+	rm.mu.Lock()
+	matches := make([]*match, 0, len(rm.rooms))
+	for _, m := range rm.rooms {
+		if !m.private {
+			matches = append(matches, m)
+		}
+	}
+	rm.mu.Unlock()
+
+	rooms := make([]RoomInfo, 0, len(matches))
+	for _, m := range matches {
+		if info, ok := m.info(); ok {
+			rooms = append(rooms, info)
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		a, _ := strconv.Atoi(rooms[i].ID)
+		b, _ := strconv.Atoi(rooms[j].ID)
+		return a < b
+	})
+	return rooms
+}
+
+// remove forgets a room that has closed
+func (rm *roomManager) remove(m *match) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.rooms[m.id] == m {
+		delete(rm.rooms, m.id)
+	}
+	if rm.codes[m.code] == m {
+		delete(rm.codes, m.code)
+	}
+}
+
+// all returns every room
+func (rm *roomManager) all() []*match {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	matches := make([]*match, 0, len(rm.rooms))
+	for _, m := range rm.rooms {
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// stopAll stops every room and waits for them to finish. No rooms can be
+// created afterwards.
+func (rm *roomManager) stopAll() {
+	rm.mu.Lock()
+	rm.closed = true
+	rm.mu.Unlock()
+
+	for _, m := range rm.all() {
+		m.close()
+	}
+}
+
+// hashPassword returns the SHA-256 digest of a room password, so rooms
+// never hold the password itself
+func hashPassword(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return sum[:]
+}
+
+// checkPassword reports whether password opens the room. Rooms without a
+// password accept anything.
+func (m *match) checkPassword(password string) bool {
+	if m.passwordHash == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare(m.passwordHash, hashPassword(password)) == 1
+}
+
+// gameSettings applies the room settings on top of base, rejecting values
+// outside the allowed limits
+func (rs RoomSettings) gameSettings(base game.GameSettings) (game.GameSettings, error) {
+	settings := base
+
+	if rs.BallCount != 0 {
+		if rs.BallCount < minBallCount || rs.BallCount > maxBallCount {
+			return settings, fmt.Errorf("ball count must be between %d and %d", minBallCount, maxBallCount)
+		}
+		settings.BallCount = rs.BallCount
+	}
+
+	if rs.TargetScore != 0 {
+		if rs.TargetScore < minTargetScore || rs.TargetScore > maxTargetScore {
+			return settings, fmt.Errorf("target score must be between %d and %d", minTargetScore, maxTargetScore)
+		}
+		settings.TargetScore = rs.TargetScore
+	}
+
+	if rs.TimeLimit != 0 {
+		limit := time.Duration(rs.TimeLimit) * time.Second
+		if limit < minTimeLimit || limit > maxTimeLimit {
+			return settings, fmt.Errorf("time limit must be between %v and %v", minTimeLimit, maxTimeLimit)
+		}
+		settings.TimeLimit = limit
+	}
+
+	return settings, nil
+}
+
+// roomSettingsFrom describes game settings as room settings
+func roomSettingsFrom(settings game.GameSettings) RoomSettings {
+	return RoomSettings{
+		BallCount:   settings.BallCount,
+		TargetScore: settings.TargetScore,
+		TimeLimit:   int(settings.TimeLimit / time.Second),
+	}
+}
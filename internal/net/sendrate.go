@@ -0,0 +1,106 @@
+package net
+
+import "time"
+
+// A room sends snapshots at its configured send rate, and each client gets
+// them at its own rate, at most the room's. A client's rate starts at the
+// room's and adapts to what its connection carries: it is cut when
+// snapshots back up in its queue or get dropped, or when its round trip
+// time swells well past the best it has had, and creeps back up while the
+// connection keeps up.
+const (
+	// minSendRate is the lowest rate a client's snapshots are cut to, in
+	// snapshots per second
+	minSendRate = 10.0
+
+	// sendRateIncrease is how much a client's rate grows at each
+	// adaptation while its connection keeps up
+	sendRateIncrease = 5.0
+
+	// congestedQueueDepth is how many messages waiting in a client's queue
+	// count as a backlog
+	congestedQueueDepth = 4
+
+	// congestedRTTSlack is how far over twice its best round trip time a
+	// client's may get before the delay counts as queueing
+	congestedRTTSlack = 50 * time.Millisecond
+)
+
+// sendRate decides which of a room's snapshots go to one client. Only the
+// match goroutine uses it.
+type sendRate struct {
+	max    float64 // the room's send rate
+	rate   float64 // the client's current rate
+	credit float64 // how far the client is towards its next snapshot
+
+	// The best round trip time seen, and the drop and sent counts at the
+	// last adaptation
+	minRTT      time.Duration
+	lastAdapt   time.Time
+	lastDropped uint64
+	lastSent    uint64
+}
+
+// newSendRate creates a send rate that starts at the room's rate
+func newSendRate(roomRate float64) *sendRate {
+	return &sendRate{max: roomRate, rate: roomRate}
+}
+
+// due reports whether the client should get the room's next snapshot.
+// Call it once for every snapshot the room sends.
+func (r *sendRate) due() bool {
+	return takeCredit(&r.credit, r.rate/r.max)
+}
+
+// takeCredit adds share, a fraction of one, to credit and reports whether
+// that makes a whole one, which it takes. Rounding is allowed for so that
+// a share of a third comes out as exactly every third call.
+func takeCredit(credit *float64, share float64) bool {
+	*credit += share
+	if *credit < 1-1e-9 {
+		return false
+	}
+	*credit = max(*credit-1, 0)
+	return true
+}
+
+// current returns the client's send rate in snapshots per second
+func (r *sendRate) current() float64 {
+	return r.rate
+}
+
+// adapt adjusts the rate to the client's connection, given its round trip
+// time, its queue and how many snapshots have actually gone out to it. It
+// is meant to be called about once a second.
+func (r *sendRate) adapt(now time.Time, rtt time.Duration, queue QueueStats, sent uint64) {
+	elapsed := now.Sub(r.lastAdapt)
+	first := r.lastAdapt.IsZero()
+	dropped := queue.Dropped - r.lastDropped
+	delivered := sent - r.lastSent
+	r.lastAdapt, r.lastDropped, r.lastSent = now, queue.Dropped, sent
+
+	// The best round trip time drifts up slowly, so that a connection that
+	// has moved to a longer route is not taken as congested for good
+	if rtt > 0 {
+		if r.minRTT == 0 || rtt < r.minRTT {
+			r.minRTT = rtt
+		} else {
+			r.minRTT += (rtt - r.minRTT) / 32
+		}
+	}
+	if first || elapsed <= 0 {
+		return
+	}
+
+	congested := dropped > 0 || queue.Depth > congestedQueueDepth ||
+		(r.minRTT > 0 && rtt > 2*r.minRTT+congestedRTTSlack)
+	if !congested {
+		r.rate = min(r.rate+sendRateIncrease, r.max)
+		return
+	}
+
+	// Back off by half, or further if that is still more than the
+	// connection managed to carry
+	rate := min(r.rate/2, float64(delivered)/elapsed.Seconds())
+	r.rate = min(max(rate, minSendRate), r.max)
+}
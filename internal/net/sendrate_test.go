@@ -0,0 +1,61 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSendRateAdapts checks that a client's rate backs off when its queue
+// backs up or its round trip time swells, and recovers once it keeps up
+func TestSendRateAdapts(t *testing.T) {
+	r := newSendRate(60)
+	now := time.Now()
+	rtt := 20 * time.Millisecond
+	sent := uint64(0)
+	second := func(queue QueueStats, rtt time.Duration) {
+		now = now.Add(time.Second)
+		for i := 0; i < 60; i++ {
+			if r.due() {
+				sent++
+			}
+		}
+		r.adapt(now, rtt, queue, sent)
+	}
+
+	r.adapt(now, rtt, QueueStats{}, sent)
+	second(QueueStats{}, rtt)
+	if r.current() != 60 || sent != 60 {
+		t.Fatalf("expected every snapshot at the full rate, got %v/s and %d sent", r.current(), sent)
+	}
+
+	second(QueueStats{Depth: congestedQueueDepth + 1}, rtt)
+	if r.current() != 30 {
+		t.Fatalf("expected a backlog to halve the rate, got %v/s", r.current())
+	}
+
+	// Only 12 of the next second's snapshots make it out
+	now = now.Add(time.Second)
+	r.adapt(now, rtt, QueueStats{Dropped: 18}, sent+12)
+	sent += 12
+	if r.current() != 12 {
+		t.Fatalf("expected the rate cut to what got through, got %v/s", r.current())
+	}
+
+	second(QueueStats{Dropped: 18}, 10*rtt)
+	if r.current() != minSendRate {
+		t.Fatalf("expected a swollen round trip to cut the rate to %v/s, got %v/s", minSendRate, r.current())
+	}
+
+	before := sent
+	second(QueueStats{Dropped: 18}, rtt)
+	if r.current() != minSendRate+sendRateIncrease || sent-before != minSendRate {
+		t.Fatalf("expected %v snapshots and then a rate of %v/s, got %d and %v/s",
+			minSendRate, minSendRate+sendRateIncrease, sent-before, r.current())
+	}
+	for i := 0; i < 20; i++ {
+		second(QueueStats{Dropped: 18}, rtt)
+	}
+	if r.current() != 60 {
+		t.Fatalf("expected the rate to recover to 60/s, got %v/s", r.current())
+	}
+}
@@ -1,271 +1,1088 @@
 package net
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"network-pong-battle/internal/game"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-// Client represents a connected client
+// flushTimeout is how long a disconnecting client's queued messages may
+// take to write before the connection is closed regardless
+const flushTimeout = time.Second
+
+// maxPlayerNameLength is the longest name a player may go by, in
+// characters
+const maxPlayerNameLength = 16
+
+// Client represents a connected client. The connection goroutine owns
+// match, name and everything learned from the client's hello, and the
+// match goroutine owns playerID, playerName, spectator and lastInput once
+// the client has joined. The match reads name, the name the client asked
+// for, while the connection goroutine waits for it to seat the client.
+// The latency tracker and outbound queue are safe to use from any
+// goroutine.
 type Client struct {
+	match      *match
 	conn       net.Conn
 	playerID   int
 	playerName string
-	mu         sync.Mutex
+	spectator  bool
+	lastInput  time.Time
+	latency    *latencyTracker
+	queue      *outQueue
+
+	// Set by the handshake. Clients that skip it speak protocol version 1
+	// with JSON encoding. version stays 0 until one or the other is known.
+	version  int
+	features []string
+	name     string // checked by setName
+	role     string
+	binary   bool // Binary frames were agreed; see FeatureEncodingBinary
+	deltas   bool // Delta snapshots were agreed; see FeatureDeltaSnapshots
+
+	// Set if UDP was agreed: the server's socket and the token the client
+	// binds its address with. udpAddr is where to send datagrams once it
+	// has, and joined mirrors match for the goroutine reading datagrams.
+	udp      *net.UDPConn
+	udpToken string
+	udpAddr  atomic.Pointer[net.UDPAddr]
+	joined   atomic.Pointer[match]
+
+	// The latest snapshot the client acknowledged, and the last keyframe
+	// it was sent. Only the match goroutine touches these.
+	ackedTick    uint32
+	keyframeTick uint32
+	wantKeyframe bool
+
+	// Which of the room's snapshots the client gets, which only the match
+	// goroutine touches, and how many have actually gone out to it
+	sendRate      *sendRate
+	snapshotsSent atomic.Uint64
+}
+
+// ServerConfig holds configurable server behaviour
+type ServerConfig struct {
+	// BotOnDisconnect hands a disconnected player's paddles to a bot so the
+	// match can continue, instead of ending it. The bot takes over at once,
+	// rather than the game pausing for the reconnect grace period, and
+	// hands the paddles back if the player resumes within it.
+	BotOnDisconnect bool
+
+	// BotIdleTimeout hands a player's paddles to a bot after this long
+	// without input. The player takes back control by sending input again.
+	// Zero disables idle substitution.
+	BotIdleTimeout time.Duration
+
+	// QueueSize is how many outbound messages each client may have waiting
+	// before QueuePolicy applies. Zero or less means DefaultQueueSize.
+	QueueSize int
+
+	// QueuePolicy decides what to do when a client's queue is full
+	QueuePolicy QueuePolicy
+
+	// WriteTimeout is how long a single write to a client may block before
+	// the client is disconnected
+	WriteTimeout time.Duration
+
+	// MaxRooms limits how many rooms can exist at once. Zero means no limit.
+	MaxRooms int
+
+	// MaxSpectators limits how many spectators can watch each room. Zero
+	// means no limit.
+	MaxSpectators int
+
+	// ReconnectGrace is how long a player who loses their connection during
+	// a game keeps their seat. The game pauses until they resume with their
+	// token or the grace period runs out. Zero frees the seat at once.
+	ReconnectGrace time.Duration
+
+	// AbandonPolicy decides how a game ends once a player has left it for
+	// good, unless BotOnDisconnect lets a bot play on
+	AbandonPolicy AbandonPolicy
+
+	// SpectatorDelay holds back everything spectators are sent by this
+	// long, so they cannot relay the game to a player as it happens
+	SpectatorDelay time.Duration
+
+	// KeyframeInterval is how often players who get delta snapshots are
+	// sent a full one regardless. Zero or less, or less than a tick, sends
+	// every snapshot full, which turns delta snapshots off.
+	KeyframeInterval time.Duration
+
+	// TickRate is how many times per second each room simulates its game
+	TickRate int
+
+	// SendRate is how many snapshots per second each room sends, at most
+	// TickRate. Each client's rate starts there and drops when its
+	// connection cannot keep up.
+	SendRate int
+
+	// UDPPort is the port to take UDP datagrams on, for clients that want
+	// snapshots and inputs sent over UDP, on the interface the server
+	// listens on. Empty disables UDP; "0" picks a free port.
+	UDPPort string
+
+	// WSPort is the port to take WebSocket connections on, for browsers,
+	// on the interface the server listens on. They speak the same protocol
+	// and share rooms with TCP clients. Empty disables WebSocket.
+	WSPort string
+
+	// AllowedOrigins lists the web origins, such as
+	// https://pong.example.com, whose pages may connect over WebSocket.
+	// Browsers name the page connecting in the Origin header, and one from
+	// any other origin is refused, so a site a player visits cannot play
+	// as them. Pages served from the WebSocket address itself and clients
+	// that send no Origin, which are not browsers, are always allowed. "*"
+	// allows every origin.
+	AllowedOrigins []string
+
+	// MaxMessageSize is the largest message a client may send, in bytes.
+	// A client that sends a bigger one is told why and disconnected. Zero
+	// means DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	// IdleTimeout disconnects a client nothing has been heard from for
+	// this long, as if it had hung up. Clients are pinged every second and
+	// answer, so only a dead connection goes that quiet. Zero disables it.
+	IdleTimeout time.Duration
+
+	// TLS, if set, encrypts TCP and WebSocket connections with it; see
+	// ServerTLSConfig. UDP datagrams are not encrypted.
+	TLS *tls.Config
 }
 
-// Server represents the game server
+// DefaultServerConfig returns the default server configuration
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		BotOnDisconnect: false,
+		BotIdleTimeout:  0,
+		QueueSize:       DefaultQueueSize,
+		QueuePolicy:     QueuePolicyDropState,
+		WriteTimeout:    2 * time.Second,
+		MaxRooms:        32,
+		MaxSpectators:   16,
+		ReconnectGrace:  30 * time.Second,
+		AbandonPolicy:   AbandonPolicyForfeit,
+		SpectatorDelay:  0,
+
+		KeyframeInterval: time.Second,
+		TickRate:         game.BaseTickRate,
+		SendRate:         game.BaseTickRate,
+		MaxMessageSize:   DefaultMaxMessageSize,
+		IdleTimeout:      DefaultIdleTimeout,
+	}
+}
+
+// Server represents the game server. It hosts any number of rooms, each
+// running its own match.
 type Server struct {
-	listener    net.Listener
-	clients     map[int]*Client
-	game        *game.Game
-	mu          sync.RWMutex
-	port        string
-	running     bool
-	gameStarted bool
-	clientCount int
-}
-
-// NewServer creates a new game server
-func NewServer(port string) *Server {
+	listener net.Listener
+	rooms    *roomManager
+	addr     string
+	running  atomic.Bool
+	config   ServerConfig
+
+	// Every goroutine the server starts is counted in wg, so Stop can wait
+	// for them. lifeMu keeps Stop from starting to wait while one is being
+	// counted.
+	wg     sync.WaitGroup
+	lifeMu sync.Mutex
+
+	// Every connected client, so those not in a room can be told when the
+	// server shuts down
+	clientsMu sync.Mutex
+	clients   map[*Client]struct{}
+
+	// The WebSocket listener and the HTTP server on it, if enabled
+	wsListener net.Listener
+	wsServer   *http.Server
+
+	// The UDP socket, if enabled, and the clients using it by their token
+	// and by their address
+	udp        *net.UDPConn
+	udpMu      sync.Mutex
+	udpTokens  map[string]*Client
+	udpClients map[string]*Client
+}
+
+// NewServer creates a new game server with the default configuration. It
+// listens on addr, which is a port, a host:port, or a URL such as
+// tcp://[::1]:9000 or unix:///tmp/pong.sock.
+func NewServer(addr string) *Server {
+	return NewServerWithConfig(addr, DefaultServerConfig())
+}
+
+// NewServerWithConfig creates a new game server with the given
+// configuration, listening on addr as NewServer does
+func NewServerWithConfig(addr string, config ServerConfig) *Server {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
 	return &Server{
-		clients:     make(map[int]*Client),
-		game:        game.NewGame(),
-		port:        port,
-		running:     false,
-		gameStarted: false,
-		clientCount: 0,
+		rooms:      newRoomManager(config),
+		addr:       addr,
+		config:     config,
+		clients:    make(map[*Client]struct{}),
+		udpTokens:  make(map[string]*Client),
+		udpClients: make(map[string]*Client),
 	}
 }
 
-// Start starts the server
+// Start starts the server on its address
 func (s *Server) Start() error {
-	var err error
-	s.listener, err = net.Listen("tcp", ":"+s.port)
+	listener, err := listen(s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to start server: %v", err)
 	}
+	return s.StartListener(listener)
+}
 
-	s.running = true
-	log.Printf("Server started on port %s", s.port)
+// StartListener starts the server on a listener the caller opened, which
+// the server closes when it stops. The server's own address is not used.
+func (s *Server) StartListener(listener net.Listener) error {
+	s.listener = listener
+	if s.config.TLS != nil {
+		s.listener = tls.NewListener(s.listener, s.config.TLS)
+	}
+	if s.config.UDPPort != "" {
+		if err := s.listenUDP(); err != nil {
+			s.listener.Close()
+			return fmt.Errorf("failed to start server: %v", err)
+		}
+	}
+	if s.config.WSPort != "" {
+		if err := s.listenWebSocket(); err != nil {
+			s.listener.Close()
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return fmt.Errorf("failed to start server: %v", err)
+		}
+	}
+
+	s.running.Store(true)
+	log.Printf("Server started on %s", s.listener.Addr())
 
 	// Start accepting clients
-	go s.acceptClients()
+	s.goTracked(s.acceptClients)
+	if s.udp != nil {
+		s.goTracked(s.readDatagrams)
+	}
+	if s.wsServer != nil {
+		s.goTracked(func() { s.wsServer.Serve(s.wsListener) })
+	}
 
-	// Start game loop
-	go s.gameLoop()
+	return nil
+}
 
+// Run starts the server and runs it until ctx is done, then stops it
+// gracefully. It returns once every goroutine the server started has
+// exited.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	s.Stop()
+	return nil
+}
+
+// Serve runs the server on a listener the caller opened, as Run does
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	if err := s.StartListener(listener); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	s.Stop()
 	return nil
 }
 
-// Stop stops the server
+// Stop stops the server gracefully. No more clients are taken, every
+// client is sent an end message saying the server is shutting down, and
+// each connection is closed once its queue has been written. Stop returns
+// once every goroutine the server started has exited.
 func (s *Server) Stop() {
-	s.running = false
-	if s.listener != nil {
-		s.listener.Close()
+	s.lifeMu.Lock()
+	wasRunning := s.running.Swap(false)
+	s.lifeMu.Unlock()
+	if !wasRunning {
+		return
+	}
+	log.Println("Shutting down server...")
+
+	s.listener.Close()
+	if s.wsServer != nil {
+		s.wsServer.Close()
 	}
 
-	// Close all client connections
-	s.mu.Lock()
-	for _, client := range s.clients {
-		client.conn.Close()
+	// Stopping the rooms tells the clients in them, and closes their queues
+	s.rooms.stopAll()
+
+	// No client can join a room now, so the rest are still in the lobby
+	s.clientsMu.Lock()
+	for client := range s.clients {
+		if client.joined.Load() == nil {
+			client.send(CreateEndMessage(0, game.Scores{}, 0, nil, EndReasonShutdown))
+			client.queue.close()
+		}
+	}
+	s.clientsMu.Unlock()
+
+	if s.udp != nil {
+		s.udp.Close()
 	}
-	s.clients = make(map[int]*Client)
-	s.mu.Unlock()
 
+	s.wg.Wait()
 	log.Println("Server stopped")
 }
 
+// goTracked runs fn on its own goroutine, which Stop waits for. It must be
+// called while the server is running or from a goroutine Stop waits for.
+func (s *Server) goTracked(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// track counts a goroutine the server did not start itself, such as one
+// serving an HTTP request, for Stop to wait for. It returns false once the
+// server is stopping, and the caller should give up. Otherwise the caller
+// calls s.wg.Done when it finishes.
+func (s *Server) track() bool {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if !s.running.Load() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// Addr returns the address the server is listening on, or nil before Start
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
 // acceptClients accepts incoming client connections
 func (s *Server) acceptClients() {
-	for s.running {
+	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			if s.running {
-				log.Printf("Error accepting connection: %v", err)
+			if !s.running.Load() {
+				return
 			}
+			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
 
-		// Check if we can accept more clients
-		s.mu.Lock()
-		if len(s.clients) >= 2 {
-			conn.Close()
-			log.Println("Game is full, rejecting connection")
-			s.mu.Unlock()
-			continue
-		}
-		s.mu.Unlock()
-
 		// Handle new client
-		go s.handleClient(conn)
+		s.goTracked(func() { s.handleClient(conn) })
 	}
 }
 
 // handleClient handles a single client connection
 func (s *Server) handleClient(conn net.Conn) {
-	defer conn.Close()
-
-	// Assign player ID
-	s.mu.Lock()
-	s.clientCount++
-	playerID := s.clientCount
 	client := &Client{
-		conn:       conn,
-		playerID:   playerID,
-		playerName: fmt.Sprintf("Player %d", playerID),
+		conn:    conn,
+		latency: newLatencyTracker(),
+		queue:   newOutQueue(s.config.QueueSize, s.config.QueuePolicy),
 	}
-	s.clients[playerID] = client
 
-	// Check if we have 2 players and can start the game
-	shouldStartGame := len(s.clients) == 2 && !s.gameStarted
-	s.mu.Unlock()
+	// Writes happen on their own goroutine so a slow client only delays
+	// itself
+	written := make(chan struct{})
+	s.goTracked(func() {
+		client.writeLoop(s.config.WriteTimeout)
+		close(written)
+	})
 
-	log.Printf("Client %d connected from %s", playerID, conn.RemoteAddr())
+	// Give the writer a moment to send what is queued, such as an error
+	// saying why we are hanging up, before closing the connection. Closing
+	// with unread data resets the connection, which can throw away that
+	// error before the client reads it, so the writer stops writing first
+	// and we read whatever the client still had in flight.
+	defer func() {
+		client.queue.close()
+		select {
+		case <-written:
+		case <-time.After(flushTimeout):
+		}
+		conn.SetReadDeadline(time.Now().Add(flushTimeout))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
 
-	// Send join confirmation
-	joinMsg := CreateJoinMessage(playerID, client.playerName)
-	if data, err := EncodeMessage(joinMsg); err == nil {
-		conn.Write(data)
-		conn.Write([]byte("\n"))
-	}
+	s.clientsMu.Lock()
+	s.clients[client] = struct{}{}
+	s.clientsMu.Unlock()
+	defer func() {
+		s.clientsMu.Lock()
+		delete(s.clients, client)
+		s.clientsMu.Unlock()
+	}()
 
-	// Start game if we have both players
-	if shouldStartGame {
-		log.Printf("Two players connected, starting game...")
-		s.startGame()
-	}
+	defer s.forgetUDP(client)
+
+	done := make(chan struct{})
+	defer close(done)
+	s.goTracked(func() { s.heartbeat(client, done) })
+
+	// Leave whichever room the client ends up in
+	defer func() {
+		if client.match != nil {
+			client.match.leave(client)
+		}
+	}()
 
 	// Handle client messages
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() && s.running {
-		data := scanner.Bytes()
-		if len(data) == 0 {
-			continue
+	reader := newMessageReader(conn, s.config.MaxMessageSize)
+	for {
+		// Once the writer has hung up, the client has until its read
+		// deadline to do the same
+		select {
+		case <-written:
+		default:
+			if s.config.IdleTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+			}
+		}
+		data, binary, err := reader.next()
+		if err != nil {
+			select {
+			case <-written:
+			default:
+				s.readFailed(client, err)
+			}
+			return
 		}
 
-		s.handleMessage(playerID, data)
+		if binary {
+			s.handleFrame(client, data)
+		} else {
+			s.handleMessage(client, data)
+		}
 	}
+}
 
-	// Client disconnected
-	s.mu.Lock()
-	delete(s.clients, playerID)
-	log.Printf("Client %d disconnected", playerID)
+// readFailed handles an error reading from a client. Hanging up is a
+// normal disconnect; a message over the limit or bytes that make no sense
+// get a fatal error so the client knows why it is disconnected. The
+// connection is left for handleClient to close, once the error is written.
+func (s *Server) readFailed(client *Client, err error) {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+	case errors.Is(err, ErrMessageTooLarge):
+		client.queueError(ErrorMessageTooLarge, err.Error(), true, false)
+	case errors.Is(err, ErrMalformedMessage):
+		client.queueError(ErrorBadInput, err.Error(), true, false)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Printf("Nothing from client %s for %v, disconnecting", client.conn.RemoteAddr(), s.config.IdleTimeout)
+	default:
+		log.Printf("Error reading from client %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// heartbeat pings a client until done is closed, so that one that only
+// speaks when spoken to is heard from often enough not to time out. Once
+// the client is in a room its match pings it instead.
+func (s *Server) heartbeat(client *Client, done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 
-	// Stop game if not enough players
-	if len(s.clients) < 2 && s.gameStarted {
-		s.stopGame()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if client.joined.Load() == nil {
+				client.send(client.latency.nextPing(time.Now()))
+			}
+		}
 	}
-	s.mu.Unlock()
 }
 
-// handleMessage processes a message from a client
-func (s *Server) handleMessage(playerID int, data []byte) {
-	var msg InputMessage
-	if err := DecodeMessage(data, &msg); err != nil {
-		log.Printf("Error decoding message from client %d: %v", playerID, err)
+// handleFrame processes a binary frame from a client. Inputs and acks are
+// decoded directly; anything else is JSON inside the frame.
+func (s *Server) handleFrame(client *Client, payload []byte) {
+	if !client.binary {
+		client.badMessage("frame", fmt.Errorf("binary encoding was not agreed"))
 		return
 	}
 
-	if msg.Type == MessageTypeInput {
-		// Update paddle positions
-		s.game.UpdatePaddle(playerID, 1, 0, msg.Paddle1Y)
-		s.game.UpdatePaddle(playerID, 2, msg.Paddle2X, 0)
+	msg, data, err := DecodeBinary(payload)
+	if err != nil {
+		client.badMessage("frame", err)
+		return
+	}
+	if data != nil {
+		s.handleMessage(client, data)
+		return
+	}
+
+	switch m := msg.(type) {
+	case *InputMessage:
+		if client.match != nil {
+			client.match.input(client, *m)
+		}
+	case *AckMessage:
+		if client.match != nil {
+			client.match.ack(client, m.Tick, false)
+		}
+	default:
+		client.sendError(ErrorBadInput, "only inputs and acks may be sent as binary frames", false)
 	}
 }
 
-// startGame starts the game
-func (s *Server) startGame() {
-	s.mu.Lock()
-	if s.gameStarted {
-		s.mu.Unlock()
-		return // Game already started
+// handleMessage processes a message from a client. Room requests, pings
+// and pongs are handled here; inputs go to the client's match.
+func (s *Server) handleMessage(client *Client, data []byte) {
+	receivedAt := time.Now()
+
+	var baseMsg struct {
+		Type MessageType `json:"type"`
+	}
+	if err := DecodeMessage(data, &baseMsg); err != nil {
+		client.badMessage("message", err)
+		return
 	}
 
-	log.Println("Starting game with 2 players...")
-	s.gameStarted = true
-	s.game.Start()
-	s.mu.Unlock()
+	// A client that starts with anything but a hello speaks protocol
+	// version 1: a player, in JSON, with none of the optional features.
+	// Pings and pongs do not count, as the heartbeat starts before it.
+	if client.version == 0 && baseMsg.Type != MessageTypeHello &&
+		baseMsg.Type != MessageTypePing && baseMsg.Type != MessageTypePong {
+		client.version = 1
+		client.role = RolePlayer
+		log.Printf("Client %s skipped the hello, speaking protocol version 1", client.conn.RemoteAddr())
+	}
 
-	// Send start message to all clients
-	startMsg := CreateStartMessage(s.game.GetState().Settings)
-	log.Printf("Broadcasting start message to %d clients", len(s.clients))
-	s.broadcastMessage(startMsg)
+	switch baseMsg.Type {
+	case MessageTypeInput:
+		var msg InputMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("input", err)
+			return
+		}
+		if client.match != nil {
+			client.match.input(client, msg)
+		}
 
-	log.Println("Game started!")
-}
+	case MessageTypeHello:
+		var msg HelloMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("hello", err)
+			return
+		}
+		s.hello(client, &msg)
 
-// stopGame stops the game
-func (s *Server) stopGame() {
-	s.gameStarted = false
-	s.game.Stop()
+	case MessageTypeCreateRoom:
+		var msg CreateRoomMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("create_room", err)
+			return
+		}
+		s.createRoom(client, &msg)
+
+	case MessageTypeListRooms:
+		client.send(CreateRoomListMessage(s.rooms.list()))
+
+	case MessageTypeJoinRoom:
+		var msg JoinRoomMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("join_room", err)
+			return
+		}
+		s.joinRoom(client, &msg)
 
-	// Send end message to all clients
-	endMsg := CreateEndMessage(0, game.Scores{}, 0)
-	s.broadcastMessage(endMsg)
+	case MessageTypeResume:
+		var msg ResumeMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("resume", err)
+			return
+		}
+		s.resume(client, &msg)
+
+	case MessageTypeAck:
+		var msg AckMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("ack", err)
+			return
+		}
+		if client.match != nil {
+			client.match.ack(client, msg.Tick, false)
+		}
 
-	log.Println("Game stopped")
+	case MessageTypeKeyframeRequest:
+		if client.match != nil {
+			client.match.ack(client, 0, true)
+		}
+
+	case MessageTypePing:
+		var msg PingMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("ping", err)
+			return
+		}
+		client.send(createPong(&msg, receivedAt))
+
+	case MessageTypePong:
+		var msg PongMessage
+		if err := DecodeMessage(data, &msg); err != nil {
+			client.badMessage("pong", err)
+			return
+		}
+		client.latency.handlePong(&msg, receivedAt)
+
+	default:
+		client.sendError(ErrorBadInput, fmt.Sprintf("unknown message type %q", baseMsg.Type), false)
+	}
 }
 
-// gameLoop runs the main game loop
-func (s *Server) gameLoop() {
-	ticker := time.NewTicker(time.Second / 60) // 60 FPS
-	defer ticker.Stop()
+// features lists the optional protocol features this server supports for
+// a client. UDP is only offered over TCP, as a UDP hello is checked against
+// the host the client is connected from.
+func (s *Server) features(client *Client) []string {
+	features := []string{FeatureEncodingJSON, FeatureEncodingBinary, FeatureDeltaSnapshots}
+	if _, tcp := client.conn.RemoteAddr().(*net.TCPAddr); tcp && s.udp != nil {
+		features = append(features, FeatureTransportUDP)
+	}
+	return features
+}
+
+// hello negotiates the protocol version and features with a client, or
+// turns it away if there is nothing both sides speak
+func (s *Server) hello(client *Client, msg *HelloMessage) {
+	if client.version != 0 {
+		log.Printf("Ignoring repeated hello from %s", client.conn.RemoteAddr())
+		return
+	}
+	// The match reads what was agreed, so it cannot change once seated
+	if client.match != nil {
+		client.sendError(ErrorBadInput, "hello must come before joining a room", false)
+		return
+	}
 
-	for s.running {
-		<-ticker.C
-		if s.gameStarted {
-			s.game.Update()
-
-			// Broadcast game state to all clients
-			stateMsg := CreateStateMessage(s.game.GetState())
-			s.broadcastMessage(stateMsg)
-
-			// Check if game ended
-			if s.game.IsGameOver() {
-				s.gameStarted = false
-				endMsg := CreateEndMessage(
-					s.game.GetWinner(),
-					s.game.GetScore(),
-					int64(s.game.GetGameTime().Milliseconds()),
-				)
-				s.broadcastMessage(endMsg)
-				log.Printf("Game ended! Winner: Player %d", s.game.GetWinner())
+	if msg.Version < MinProtocolVersion {
+		client.sendError(ErrorVersionMismatch, fmt.Sprintf("protocol version %d is not supported, only %d to %d",
+			msg.Version, MinProtocolVersion, ProtocolVersion), true)
+		return
+	}
+	role := msg.Role
+	if role == "" {
+		role = RolePlayer
+	}
+	if role != RolePlayer && role != RoleSpectator {
+		client.sendError(ErrorInvalidRole, fmt.Sprintf("unknown role %q", msg.Role), true)
+		return
+	}
+
+	client.version = msg.Version
+	if client.version > ProtocolVersion {
+		client.version = ProtocolVersion
+	}
+	client.features = nil
+	for _, feature := range s.features(client) {
+		for _, offered := range msg.Features {
+			if feature == offered {
+				client.features = append(client.features, feature)
+				break
 			}
 		}
 	}
-}
+	client.name = msg.Name
+	client.role = role
 
-// broadcastMessage sends a message to all connected clients
-func (s *Server) broadcastMessage(msg interface{}) {
-	data, err := EncodeMessage(msg)
+	client.binary = client.hasFeature(FeatureEncodingBinary)
+	client.deltas = client.hasFeature(FeatureDeltaSnapshots)
+
+	log.Printf("Client %s (%q) speaks protocol %d as a %s, features %v",
+		client.conn.RemoteAddr(), client.name, client.version, client.role, client.features)
+	welcome := CreateWelcomeMessage(client.version, client.features)
+	if client.hasFeature(FeatureTransportUDP) {
+		if err := s.offerUDP(client, welcome); err != nil {
+			log.Printf("Client %s will stay on TCP: %v", client.conn.RemoteAddr(), err)
+		}
+	}
+	out, err := newOutboundMessage(welcome)
 	if err != nil {
 		log.Printf("Error encoding message: %v", err)
 		return
 	}
-	data = append(data, '\n')
+	// The welcome itself is always JSON, so the client can read it before
+	// it knows which encoding was agreed
+	out.startBinary = client.binary
+	client.enqueue(out)
+}
+
+// createRoom creates a room with the requested settings and seats the
+// client in it. The creator is told the room's join code first, so they can
+// pass it on while waiting for an opponent.
+func (s *Server) createRoom(client *Client, msg *CreateRoomMessage) {
+	if client.match != nil {
+		client.sendError(ErrorAlreadyInRoom, "already in room "+client.match.id, false)
+		return
+	}
+
+	settings, err := msg.Settings.gameSettings(game.DefaultSettings())
+	if err == nil && len(msg.Password) > maxPasswordLength {
+		err = fmt.Errorf("password is longer than %d characters", maxPasswordLength)
+	}
+	if err != nil {
+		client.sendError(ErrorInvalidSettings, err.Error(), false)
+		return
+	}
+	if err := checkPrintable(strings.TrimSpace(msg.Name)); err != nil {
+		client.sendError(ErrorInvalidName, "room name "+err.Error(), false)
+		return
+	}
+	if !client.setName(msg.PlayerName) {
+		return
+	}
+
+	m, err := s.rooms.create(msg.Name, settings, msg.Private, msg.Password)
+	if err != nil {
+		client.sendError(ErrorTooManyRooms, err.Error(), false)
+		return
+	}
+	log.Printf("Room %s (%q) created by %s", m.id, m.name, client.conn.RemoteAddr())
+
+	client.send(CreateRoomCreatedMessage(m.id, m.name, m.code))
+	s.seat(client, m, false)
+}
+
+// joinRoom seats the client in the room named by join code or ID, or in any
+// open room if neither was given. Private rooms can only be joined by code.
+// Spectators are let in to watch instead of being seated.
+func (s *Server) joinRoom(client *Client, msg *JoinRoomMessage) {
+	if client.match != nil {
+		client.sendError(ErrorAlreadyInRoom, "already in room "+client.match.id, false)
+		return
+	}
+
+	// A client that said hello as a spectator always watches
+	if client.role == RoleSpectator {
+		msg.Spectate = true
+	}
+	if !client.setName(msg.PlayerName) {
+		return
+	}
+
+	if msg.Code != "" || msg.RoomID != "" {
+		var m *match
+		if msg.Code != "" {
+			m = s.rooms.byCode(msg.Code)
+		} else if m = s.rooms.get(msg.RoomID); m != nil && m.private {
+			m = nil
+		}
+		if m == nil {
+			client.sendError(ErrorUnknownRoom, "no such room", false)
+			return
+		}
+		if !m.checkPassword(msg.Password) {
+			client.sendError(ErrorAuthFailed, "wrong password for room "+m.id, false)
+			return
+		}
+		if s.seat(client, m, msg.Spectate) {
+			return
+		}
+		if msg.Spectate {
+			client.sendError(ErrorSpectatorsFull, "room "+m.id+" has no room for more spectators", false)
+		} else {
+			client.sendError(ErrorRoomFull, "room "+m.id+" is full", false)
+		}
+		return
+	}
+
+	if msg.Spectate {
+		m := s.rooms.watchable()
+		if m == nil {
+			client.sendError(ErrorUnknownRoom, "no room to watch", false)
+			return
+		}
+		if !s.seat(client, m, true) {
+			client.sendError(ErrorSpectatorsFull, "room "+m.id+" has no room for more spectators", false)
+		}
+		return
+	}
+
+	// A room can fill up between finding it and joining it, so retry a
+	// few times before giving up
+	for attempt := 0; attempt < 3; attempt++ {
+		m, err := s.rooms.open()
+		if err != nil {
+			client.sendError(ErrorTooManyRooms, err.Error(), false)
+			return
+		}
+		if s.seat(client, m, false) {
+			return
+		}
+	}
+	client.sendError(ErrorRoomFull, "no open room available", false)
+}
+
+// resume gives a reconnecting player back the seat their token was issued
+// for
+func (s *Server) resume(client *Client, msg *ResumeMessage) {
+	if client.match != nil {
+		client.sendError(ErrorAlreadyInRoom, "already in room "+client.match.id, false)
+		return
+	}
+
+	roomID, _, _ := strings.Cut(msg.Token, ".")
+	m := s.rooms.get(roomID)
+	if m == nil || !m.resume(client, msg.Token) {
+		client.sendError(ErrorInvalidToken, "seat is no longer held", false)
+		return
+	}
+	client.match = m
+	client.joined.Store(m)
+}
+
+// seat asks a room to take the client, as a player or a spectator, and
+// remembers the room if it does
+func (s *Server) seat(client *Client, m *match, spectate bool) bool {
+	if !m.join(client, spectate) {
+		return false
+	}
+	client.match = m
+	client.joined.Store(m)
+	return true
+}
+
+// ListRooms describes every room on the server
+func (s *Server) ListRooms() []RoomInfo {
+	return s.rooms.list()
+}
 
-	s.mu.RLock()
-	for _, client := range s.clients {
-		client.mu.Lock()
-		client.conn.Write(data)
-		client.mu.Unlock()
+// EndMatch ends the game running in a room, with no winner. It returns
+// false if the room does not exist or has no game running.
+func (s *Server) EndMatch(roomID string) bool {
+	m := s.rooms.get(roomID)
+	if m == nil {
+		return false
 	}
-	s.mu.RUnlock()
+	return m.endByAdmin()
 }
 
-// GetClientCount returns the number of connected clients
+// GetNetworkStats returns the measured connection quality for a player
+func (s *Server) GetNetworkStats(roomID string, playerID int) (NetworkStats, bool) {
+	client := s.findClient(roomID, playerID)
+	if client == nil {
+		return NetworkStats{}, false
+	}
+	return client.latency.stats(), true
+}
+
+// GetQueueStats returns the depth and drop count of a player's outbound queue
+func (s *Server) GetQueueStats(roomID string, playerID int) (QueueStats, bool) {
+	client := s.findClient(roomID, playerID)
+	if client == nil {
+		return QueueStats{}, false
+	}
+	return client.queue.stats(), true
+}
+
+// findClient returns a player in a room, or nil
+func (s *Server) findClient(roomID string, playerID int) *Client {
+	m := s.rooms.get(roomID)
+	if m == nil {
+		return nil
+	}
+
+	var client *Client
+	m.query(func() {
+		client = m.clients[playerID]
+	})
+	return client
+}
+
+// GetClientCount returns the number of players seated across all rooms
 func (s *Server) GetClientCount() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return len(s.clients)
+	count := 0
+	for _, room := range s.rooms.list() {
+		count += room.Players
+	}
+	return count
 }
 
-// IsGameStarted returns whether the game has started
+// IsGameStarted returns whether a game has started in any room
 func (s *Server) IsGameStarted() bool {
-	return s.gameStarted
+	for _, room := range s.rooms.list() {
+		if room.Started {
+			return true
+		}
+	}
+	return false
+}
+
+// hangUp tells the client we are done writing once its queue is closed
+// and written. A TCP connection is only closed for writing, and the client
+// has flushTimeout to hang up in turn, so that anything it still had in
+// flight does not reset the connection before it reads what we sent.
+func (c *Client) hangUp() {
+	if tcp, ok := c.conn.(interface{ CloseWrite() error }); ok && tcp.CloseWrite() == nil {
+		c.conn.SetReadDeadline(time.Now().Add(flushTimeout))
+		return
+	}
+	c.conn.Close()
+}
+
+// setName checks the name a client asked to join with, or the one from
+// its hello if it gave none, and tells the client if it is not allowed.
+// Names are trimmed, and may be up to maxPlayerNameLength printable
+// characters. The room makes the name unique when it seats the client.
+func (c *Client) setName(requested string) bool {
+	if requested == "" {
+		requested = c.name
+	}
+	name := strings.TrimSpace(requested)
+	err := checkPrintable(name)
+	if err == nil && utf8.RuneCountInString(name) > maxPlayerNameLength {
+		err = fmt.Errorf("is longer than %d characters", maxPlayerNameLength)
+	}
+	if err != nil {
+		c.sendError(ErrorInvalidName, "name "+err.Error(), false)
+		return false
+	}
+	c.name = name
+	return true
+}
+
+// checkPrintable checks that a player or room name is valid UTF-8 made up
+// of characters that can be shown
+func checkPrintable(name string) error {
+	switch {
+	case !utf8.ValidString(name):
+		return fmt.Errorf("is not valid UTF-8")
+	case strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0:
+		return fmt.Errorf("has characters that cannot be shown")
+	}
+	return nil
+}
+
+// hasFeature reports whether the feature was agreed in the handshake
+func (c *Client) hasFeature(feature string) bool {
+	for _, f := range c.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues a message for this client
+func (c *Client) send(msg interface{}) {
+	out, err := newOutboundMessage(msg)
+	if err != nil {
+		log.Printf("Error encoding message: %v", err)
+		return
+	}
+	c.enqueue(out)
+}
+
+// sendError tells the client a request failed. After a fatal error the
+// connection closes once the error has been written.
+func (c *Client) sendError(code, message string, fatal bool) {
+	c.queueError(code, message, fatal, fatal)
+}
+
+// queueError queues an error message, and closes the connection once it
+// has been written if closeAfter is set
+func (c *Client) queueError(code, message string, fatal, closeAfter bool) {
+	log.Printf("Error for %s: %s (%s)", c.conn.RemoteAddr(), message, code)
+	out, err := newOutboundMessage(CreateErrorMessage(code, message, fatal))
+	if err != nil {
+		log.Printf("Error encoding message: %v", err)
+		if closeAfter {
+			c.conn.Close()
+		}
+		return
+	}
+	out.closeAfter = closeAfter
+	c.enqueue(out)
+}
+
+// badMessage reports a message from the client that could not be decoded
+func (c *Client) badMessage(what string, err error) {
+	c.sendError(ErrorBadInput, fmt.Sprintf("could not decode %s: %v", what, err), false)
+}
+
+// enqueue adds an encoded message to the client's queue, disconnecting the
+// client if its queue is full and the policy says so
+func (c *Client) enqueue(msg outboundMessage) {
+	// Snapshots go by UDP if the client has it, so a lost packet does not
+	// hold up the ones after it
+	if msg.droppable && c.sendDatagram(msg.msg) {
+		return
+	}
+	if !c.queue.push(msg) {
+		log.Printf("Client %s cannot keep up, disconnecting", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+}
+
+// writeLoop writes queued messages to the client until its queue is closed.
+// A write that fails or exceeds the write timeout closes the connection,
+// which ends the client's read loop and the normal disconnect follows.
+// Messages after a welcome that agreed on binary frames are written as
+// frames.
+func (c *Client) writeLoop(writeTimeout time.Duration) {
+	binary := false
+	for {
+		items, ok := c.queue.take()
+		if !ok {
+			c.hangUp()
+			return
+		}
+
+		for _, item := range items {
+			data := item.data
+			if binary {
+				var err error
+				if data, err = EncodeBinary(item.msg); err != nil {
+					log.Printf("Error encoding message: %v", err)
+					continue
+				}
+			}
+
+			if writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if _, err := c.conn.Write(data); err != nil {
+				log.Printf("Error writing to client %s: %v", c.conn.RemoteAddr(), err)
+				c.conn.Close()
+				c.queue.close()
+				return
+			}
+			if item.droppable {
+				c.snapshotsSent.Add(1)
+			}
+			if item.closeAfter {
+				c.conn.Close()
+				c.queue.close()
+				return
+			}
+			if item.startBinary {
+				binary = true
+			}
+		}
+	}
 }
@@ -0,0 +1,1635 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"network-pong-battle/internal/game"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server on a free loopback port and stops it when
+// the test finishes
+func startTestServer(t *testing.T, config ServerConfig) *Server {
+	t.Helper()
+
+	server := NewServerWithConfig("0", config)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	return server
+}
+
+// dialRaw connects to a server without a GameClient, so a test can speak
+// the protocol itself, and sends msgs one to a line. The connection is
+// closed when the test finishes.
+func dialRaw(t *testing.T, addr string, msgs ...interface{}) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for _, msg := range msgs {
+		data, _ := EncodeMessage(msg)
+		conn.Write(append(data, '\n'))
+	}
+	return conn
+}
+
+// rawReader returns a function that reads messages off a raw connection
+// until one of the given type, or just the next one if the type is empty
+func rawReader(t *testing.T, conn net.Conn) func(MessageType) map[string]interface{} {
+	scanner := bufio.NewScanner(conn)
+	return func(typ MessageType) map[string]interface{} {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for scanner.Scan() {
+			var msg map[string]interface{}
+			if err := DecodeMessage(scanner.Bytes(), &msg); err != nil {
+				t.Fatalf("bad message: %v", err)
+			}
+			if typ == "" || msg["type"] == string(typ) {
+				return msg
+			}
+		}
+		t.Fatalf("no %q message: %v", typ, scanner.Err())
+		return nil
+	}
+}
+
+// rawHello is the hello a raw test client opens with
+func rawHello(features ...string) *HelloMessage {
+	return CreateHelloMessage("Raw", RolePlayer, features)
+}
+
+// waitFor polls cond until it holds or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestServerConcurrentClients connects more clients than a room has seats
+// at once, has the seated players send input while the server is queried
+// from other goroutines, then disconnects everyone. Run it with -race.
+func TestServerConcurrentClients(t *testing.T) {
+	// Free seats as soon as players leave rather than holding them
+	config := DefaultServerConfig()
+	config.ReconnectGrace = 0
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	// Create the room up front so every client races for the same seats
+	room, err := server.rooms.create("race", game.DefaultSettings(), false, "")
+	if err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	}
+	roomID := room.id
+
+	const clientCount = 6
+	var (
+		wg      sync.WaitGroup
+		states  atomic.Int64
+		seatsMu sync.Mutex
+		seats   = make(map[int]int)
+	)
+
+	for i := 0; i < clientCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			joined := make(chan int, 1)
+			client := NewClient(addr, fmt.Sprintf("Client %d", i))
+			client.SetCallbacks(
+				func(game.GameState) { states.Add(1) },
+				nil,
+				nil,
+				func(playerID int, _ string) { joined <- playerID },
+			)
+			if err := client.Connect(); err != nil {
+				t.Errorf("client %d failed to connect: %v", i, err)
+				return
+			}
+			defer client.Disconnect()
+			if err := client.JoinRoom(roomID, "", ""); err != nil {
+				t.Errorf("client %d failed to join: %v", i, err)
+				return
+			}
+
+			select {
+			case playerID := <-joined:
+				seatsMu.Lock()
+				seats[playerID]++
+				seatsMu.Unlock()
+
+				for j := 0; j < 60; j++ {
+					client.SendInput(1, -1)
+					client.GetPredictedPaddles()
+					client.GetInterpolatedState(time.Now())
+					time.Sleep(5 * time.Millisecond)
+				}
+			case <-time.After(time.Second):
+				// Turned away because the game is full
+			}
+		}(i)
+	}
+
+	// Poke at the server from outside the match while clients play
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.GetClientCount()
+				server.IsGameStarted()
+				server.GetNetworkStats(roomID, 1)
+				server.GetQueueStats(roomID, 2)
+				server.ListRooms()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+
+	if len(seats) != 2 || seats[1] != 1 || seats[2] != 1 {
+		t.Fatalf("expected players 1 and 2 seated once each, got %v", seats)
+	}
+	if states.Load() == 0 {
+		t.Fatal("no state updates received")
+	}
+
+	waitFor(t, 2*time.Second, "clients to leave", func() bool {
+		return server.GetClientCount() == 0
+	})
+	if server.IsGameStarted() {
+		t.Fatal("game still running after both players left")
+	}
+}
+
+// TestServerQuickJoinFillsRooms checks that clients joining without naming
+// a room fill one room before the next is created
+func TestServerQuickJoinFillsRooms(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+
+	for i := 0; i < 4; i++ {
+		client := NewClient(server.Addr().String(), fmt.Sprintf("Client %d", i))
+		if err := client.Connect(); err != nil {
+			t.Fatalf("client %d failed to connect: %v", i, err)
+		}
+		defer client.Disconnect()
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("client %d failed to join: %v", i, err)
+		}
+		waitFor(t, time.Second, "client to be seated", func() bool {
+			return client.GetRoomID() != ""
+		})
+	}
+
+	rooms := server.ListRooms()
+	if len(rooms) != 2 {
+		t.Fatalf("expected 2 rooms, got %+v", rooms)
+	}
+	for _, room := range rooms {
+		if room.Players != 2 || !room.Started {
+			t.Errorf("expected room %s full and started, got %+v", room.ID, room)
+		}
+	}
+}
+
+// TestServerPrivateRooms checks that a locked room takes only its
+// password, and that a private room is left out of the room list and can
+// be joined by its code but not its ID
+func TestServerPrivateRooms(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	// create opens a room and returns its ID and join code
+	create := func(name string, private bool, password string) (string, string) {
+		t.Helper()
+		conn := dialRaw(t, addr, rawHello(FeatureEncodingJSON),
+			CreateCreateRoomMessage(name, private, password, RoomSettings{}))
+		created := rawReader(t, conn)(MessageTypeRoomCreated)
+		return created["roomId"].(string), created["code"].(string)
+	}
+	locked, _ := create("Locked", false, "secret")
+	hidden, code := create("Hidden", true, "")
+
+	if rooms := server.ListRooms(); len(rooms) != 1 || rooms[0].ID != locked || !rooms[0].Locked {
+		t.Fatalf("expected only the locked room to be listed, got %+v", rooms)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		join     *JoinRoomMessage
+		wantCode string // empty if the client should be seated
+	}{
+		{"wrong password", CreateJoinRoomMessage(locked, "", "guess"), ErrorAuthFailed},
+		{"no password", CreateJoinRoomMessage(locked, "", ""), ErrorAuthFailed},
+		{"right password", CreateJoinRoomMessage(locked, "", "secret"), ""},
+		{"private room by ID", CreateJoinRoomMessage(hidden, "", ""), ErrorUnknownRoom},
+		{"private room by code", CreateJoinRoomMessage("", code, ""), ""},
+		{"unknown code", CreateJoinRoomMessage("", "ZZZZZZ", ""), ErrorUnknownRoom},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := dialRaw(t, addr, rawHello(FeatureEncodingJSON), tc.join)
+			read := rawReader(t, conn)
+			read(MessageTypeWelcome)
+			reply := read("")
+			if tc.wantCode == "" {
+				if reply["type"] != string(MessageTypeJoin) {
+					t.Fatalf("expected to be seated, got %v", reply)
+				}
+				return
+			}
+			if reply["type"] != string(MessageTypeError) || reply["code"] != tc.wantCode || reply["fatal"] == true {
+				t.Fatalf("expected a %s error, got %v", tc.wantCode, reply)
+			}
+		})
+	}
+}
+
+// TestServerRoomNames checks that room names are trimmed and cut short by
+// character, and that one with characters that cannot be shown is refused
+func TestServerRoomNames(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+
+	for _, tc := range []struct {
+		name     string
+		wantName string
+		wantCode string // empty if the room should be created
+	}{
+		{" \tLunch league ", "Lunch league", ""},
+		{strings.Repeat("é", maxRoomNameLength+8), strings.Repeat("é", maxRoomNameLength), ""},
+		{"", "Room 3", ""},
+		{"Lunch\x00league", "", ErrorInvalidName},
+	} {
+		conn := dialRaw(t, server.Addr().String(), rawHello(FeatureEncodingJSON),
+			CreateCreateRoomMessage(tc.name, false, "", RoomSettings{}))
+		read := rawReader(t, conn)
+		read(MessageTypeWelcome)
+		reply := read("")
+		if tc.wantCode != "" {
+			if reply["type"] != string(MessageTypeError) || reply["code"] != tc.wantCode {
+				t.Fatalf("expected room name %q to be refused as %s, got %v", tc.name, tc.wantCode, reply)
+			}
+			continue
+		}
+		if reply["type"] != string(MessageTypeRoomCreated) || reply["name"] != tc.wantName {
+			t.Fatalf("expected room name %q to become %q, got %v", tc.name, tc.wantName, reply)
+		}
+	}
+}
+
+// TestServerResumeAfterDrop cuts a player's connection mid-game and checks
+// that the client reconnects into the same seat while the game waits
+func TestServerResumeAfterDrop(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	var (
+		states  atomic.Int64
+		pauses  = make(chan bool, 4)
+		clients [2]*GameClient
+		joined  = make(chan int, 4)
+	)
+	for i := range clients {
+		client := NewClient(addr, fmt.Sprintf("Client %d", i))
+		client.SetCallbacks(
+			func(game.GameState) { states.Add(1) },
+			nil,
+			nil,
+			func(playerID int, _ string) { joined <- playerID },
+		)
+		client.SetPauseCallback(func(paused bool, _ int, _ time.Duration) { pauses <- paused })
+		if err := client.Connect(); err != nil {
+			t.Fatalf("client %d failed to connect: %v", i, err)
+		}
+		defer client.Disconnect()
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("client %d failed to join: %v", i, err)
+		}
+		<-joined
+		clients[i] = client
+	}
+	waitFor(t, time.Second, "game to start", server.IsGameStarted)
+
+	dropped := clients[0]
+	playerID := dropped.GetPlayerID()
+	dropped.writeMu.Lock()
+	dropped.conn.Close()
+	dropped.writeMu.Unlock()
+
+	select {
+	case paused := <-pauses:
+		if !paused {
+			t.Fatal("expected the game to pause")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("game did not pause after a player dropped")
+	}
+
+	select {
+	case id := <-joined:
+		if id != playerID {
+			t.Fatalf("resumed as player %d, expected %d", id, playerID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	waitFor(t, 2*time.Second, "game to resume", func() bool {
+		select {
+		case paused := <-pauses:
+			return !paused
+		default:
+			return false
+		}
+	})
+
+	before := states.Load()
+	waitFor(t, time.Second, "state after resuming", func() bool {
+		return states.Load() > before
+	})
+	if rooms := server.ListRooms(); len(rooms) != 1 || rooms[0].Players != 2 {
+		t.Fatalf("expected one room with both players, got %+v", rooms)
+	}
+}
+
+// TestIdleTimeouts checks that a player who goes silent is disconnected,
+// pausing the game as any other drop would, and that a client gives up on
+// a server that goes silent
+func TestIdleTimeouts(t *testing.T) {
+	config := DefaultServerConfig()
+	config.IdleTimeout = 1500 * time.Millisecond
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	pauses := make(chan bool, 4)
+	opponent := NewClient(addr, "Opponent")
+	opponent.SetPauseCallback(func(paused bool, _ int, _ time.Duration) { pauses <- paused })
+	if err := opponent.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer opponent.Disconnect()
+	opponent.JoinRoom("", "", "")
+
+	// A player that joins and then neither pings nor answers pings
+	dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+	waitFor(t, time.Second, "game to start", server.IsGameStarted)
+
+	select {
+	case paused := <-pauses:
+		if !paused {
+			t.Fatal("expected the game to pause")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("game did not pause after a player went silent")
+	}
+
+	// A server that accepts and then says nothing
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		if conn, err := silent.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	client := NewClient(silent.Addr().String(), "Client")
+	client.SetIdleTimeout(300 * time.Millisecond)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Disconnect()
+	waitFor(t, 2*time.Second, "client to drop the connection", func() bool { return !client.IsConnected() })
+}
+
+// TestServerForfeitOnLeave checks that the player who stays is awarded the
+// game when their opponent leaves for good
+func TestServerForfeitOnLeave(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReconnectGrace = 0
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	type end struct {
+		winner int
+		reason string
+	}
+	var (
+		clients [2]*GameClient
+		joined  = make(chan int, 2)
+		ends    = make(chan end, 1)
+	)
+	for i := range clients {
+		client := NewClient(addr, fmt.Sprintf("Client %d", i))
+		client.SetCallbacks(
+			nil,
+			nil,
+			func(winner int, _ game.Scores, _ int64, reason string) { ends <- end{winner, reason} },
+			func(playerID int, _ string) { joined <- playerID },
+		)
+		if err := client.Connect(); err != nil {
+			t.Fatalf("client %d failed to connect: %v", i, err)
+		}
+		defer client.Disconnect()
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("client %d failed to join: %v", i, err)
+		}
+		<-joined
+		clients[i] = client
+	}
+	waitFor(t, time.Second, "game to start", server.IsGameStarted)
+
+	stayed := clients[1].GetPlayerID()
+	clients[0].Disconnect()
+
+	select {
+	case e := <-ends:
+		if e.winner != stayed || e.reason != EndReasonForfeit {
+			t.Fatalf("expected player %d to win by forfeit, got %+v", stayed, e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no end message after the opponent left")
+	}
+}
+
+// TestServerBotSubstitution checks that a bot takes over straight away
+// for a player who drops out, without pausing the game, and for players
+// who stop sending input, and that the end message lists them
+func TestServerBotSubstitution(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		disconnect bool
+		wantBots   []interface{}
+	}{
+		{"disconnect", true, []interface{}{float64(2)}},
+		{"idle", false, []interface{}{float64(1), float64(2)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.BotOnDisconnect = tc.disconnect
+			if !tc.disconnect {
+				config.BotIdleTimeout = 200 * time.Millisecond
+			}
+			server := startTestServer(t, config)
+			addr := server.Addr().String()
+
+			stay := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+			read := rawReader(t, stay)
+			read(MessageTypeJoin)
+			leave := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+			read(MessageTypeStart)
+
+			if tc.disconnect {
+				leave.Close()
+				for {
+					msg := read("")
+					if msg["type"] == string(MessageTypePaused) {
+						t.Fatalf("expected the bot to play on, got %v", msg)
+					}
+					entries, _ := msg["entries"].([]interface{})
+					if len(entries) == 2 && entries[1].(map[string]interface{})["away"] == true {
+						break
+					}
+				}
+			}
+			// Let the game run long enough for any pause or idle bot
+			deadline := time.Now().Add(500 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				if msg := read(""); msg["type"] == string(MessageTypePaused) {
+					t.Fatalf("expected the game to go on, got %v", msg)
+				}
+			}
+
+			// Stop waits for the raw connections to hang up
+			stopped := make(chan struct{})
+			go func() {
+				server.Stop()
+				close(stopped)
+			}()
+			end := read(MessageTypeEnd)
+			stay.Close()
+			leave.Close()
+			<-stopped
+			if bots, _ := end["botPlayers"].([]interface{}); fmt.Sprint(bots) != fmt.Sprint(tc.wantBots) {
+				t.Fatalf("expected bots for players %v, got %v", tc.wantBots, end)
+			}
+		})
+	}
+}
+
+// TestServerSpectatorLimit checks that a room turns spectators away once
+// MaxSpectators are watching
+func TestServerSpectatorLimit(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxSpectators = 1
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	player := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+	room := rawReader(t, player)(MessageTypeJoin)["roomId"].(string)
+
+	for i, want := range []string{string(MessageTypeJoin), ErrorSpectatorsFull} {
+		watcher := dialRaw(t, addr, CreateHelloMessage("Watcher", RoleSpectator, []string{FeatureEncodingJSON}),
+			CreateJoinRoomMessage(room, "", ""))
+		read := rawReader(t, watcher)
+		read(MessageTypeWelcome)
+		reply := read("")
+		if reply["type"] != want && reply["code"] != want {
+			t.Fatalf("spectator %d: expected %s, got %v", i+1, want, reply)
+		}
+	}
+}
+
+// TestServerSpectatorDelay checks that spectators are sent each snapshot
+// SpectatorDelay after the players are, so many ticks behind them
+func TestServerSpectatorDelay(t *testing.T) {
+	config := DefaultServerConfig()
+	config.SpectatorDelay = 300 * time.Millisecond
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+	delayTicks := int64(config.SpectatorDelay.Seconds() * game.BaseTickRate)
+
+	player := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+	room := rawReader(t, player)(MessageTypeJoin)["roomId"].(string)
+	watcher := dialRaw(t, addr, CreateHelloMessage("Watcher", RoleSpectator, []string{FeatureEncodingJSON}),
+		CreateJoinRoomMessage(room, "", ""))
+	dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage(room, "", ""))
+
+	// Keep track of the newest tick the player has been sent
+	var playerTick atomic.Int64
+	go func() {
+		scanner := bufio.NewScanner(player)
+		for scanner.Scan() {
+			var msg StateMessage
+			if DecodeMessage(scanner.Bytes(), &msg) == nil && msg.Type == MessageTypeState {
+				playerTick.Store(int64(msg.Tick))
+			}
+		}
+	}()
+
+	read := rawReader(t, watcher)
+	for i := 0; i < 30; i++ {
+		tick := int64(read(MessageTypeState)["tick"].(float64))
+		if i < 10 {
+			continue // Let the player's reader catch up
+		}
+		if behind := playerTick.Load() - tick; behind < delayTicks/2 || behind > 2*delayTicks {
+			t.Fatalf("expected the spectator about %d ticks behind, got tick %d against %d", delayTicks, tick, playerTick.Load())
+		}
+	}
+}
+
+// TestServerSpectatorInput checks that input from a spectator moves
+// nobody's paddles
+func TestServerSpectatorInput(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	player := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+	read := rawReader(t, player)
+	room := read(MessageTypeJoin)["roomId"].(string)
+	dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage(room, "", ""))
+	watcher := dialRaw(t, addr, CreateHelloMessage("Watcher", RoleSpectator, []string{FeatureEncodingJSON}),
+		CreateJoinRoomMessage(room, "", ""))
+	rawReader(t, watcher)(MessageTypeJoin)
+
+	first := read(MessageTypeState)
+	for seq := uint32(1); seq <= 10; seq++ {
+		data, _ := EncodeMessage(CreateInputMessage(1, game.Input{Seq: seq, Vertical: 1, Horizontal: 1}))
+		watcher.Write(append(data, '\n'))
+	}
+	var last map[string]interface{}
+	for i := 0; i < 30; i++ {
+		last = read(MessageTypeState)
+	}
+	if acks, _ := last["inputAcks"].(map[string]interface{}); acks["1"] != nil {
+		t.Fatalf("expected no input applied for player 1, got acks %v", acks)
+	}
+	paddle := func(state map[string]interface{}) interface{} { return state["paddles"].([]interface{})[0] }
+	if fmt.Sprint(paddle(first)) != fmt.Sprint(paddle(last)) {
+		t.Fatalf("expected player 1's paddle to stay put, got %v then %v", paddle(first), paddle(last))
+	}
+}
+
+// TestServerSpectatorsToldWhenRoomCloses checks that spectators get an end
+// message before their connection is closed when the last player leaves,
+// including one still held back for them
+func TestServerSpectatorsToldWhenRoomCloses(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		started    bool
+		wantReason string
+	}{
+		{"before the game", false, EndReasonAbandoned},
+		{"during the game", true, EndReasonForfeit},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.ReconnectGrace = 0
+			config.SpectatorDelay = 2 * time.Second
+			server := startTestServer(t, config)
+			addr := server.Addr().String()
+
+			player := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+			room := rawReader(t, player)(MessageTypeJoin)["roomId"].(string)
+			watcher := dialRaw(t, addr, CreateHelloMessage("Watcher", RoleSpectator, []string{FeatureEncodingJSON}),
+				CreateJoinRoomMessage(room, "", ""))
+			read := rawReader(t, watcher)
+			read(MessageTypeJoin)
+			if tc.started {
+				opponent := dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage(room, "", ""))
+				waitFor(t, time.Second, "game to start", server.IsGameStarted)
+				opponent.Close()
+			}
+
+			left := time.Now()
+			player.Close()
+			end := read(MessageTypeEnd)
+			if end["reason"] != tc.wantReason {
+				t.Fatalf("expected the game to end with %q, got %v", tc.wantReason, end)
+			}
+			if waited := time.Since(left); waited >= config.SpectatorDelay {
+				t.Fatalf("expected the end message at once when the room closed, waited %v", waited)
+			}
+		})
+	}
+}
+
+// TestServerShutdown checks that stopping the server tells players and
+// clients still in the lobby why, that they hang up rather than trying to
+// reconnect, and that Stop and a client's Run return once everything has
+// wound down
+func TestServerShutdown(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	var (
+		joined = make(chan int, 2)
+		ends   = make(chan string, 3)
+	)
+	onEnd := func(_ int, _ game.Scores, _ int64, reason string) { ends <- reason }
+	for i := 0; i < 2; i++ {
+		client := NewClient(addr, fmt.Sprintf("Client %d", i))
+		client.SetCallbacks(nil, nil, onEnd, func(playerID int, _ string) { joined <- playerID })
+		if err := client.Connect(); err != nil {
+			t.Fatalf("client %d failed to connect: %v", i, err)
+		}
+		defer client.Disconnect()
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("client %d failed to join: %v", i, err)
+		}
+		<-joined
+	}
+	waitFor(t, time.Second, "game to start", server.IsGameStarted)
+
+	lobby := NewClient(addr, "Lobby")
+	lobby.SetCallbacks(nil, nil, onEnd, nil)
+	ran := make(chan error, 1)
+	go func() { ran <- lobby.Run(context.Background()) }()
+	waitFor(t, time.Second, "lobby client to connect", lobby.IsConnected)
+	waitFor(t, time.Second, "server to register the lobby client", func() bool {
+		server.clientsMu.Lock()
+		defer server.clientsMu.Unlock()
+		return len(server.clients) == 3
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case reason := <-ends:
+			if reason != EndReasonShutdown {
+				t.Fatalf("expected the game to end with %q, got %q", EndReasonShutdown, reason)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of 3 clients were told the server is shutting down", i)
+		}
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("client's Run did not return after the server went away")
+	}
+}
+
+// TestServerTLS checks that a client pinning the fingerprint of a
+// generated certificate can play, that the certificate is kept for the
+// next start, and that a client pinning another fingerprint is refused
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	tlsConfig, err := ServerTLSConfig(certFile, keyFile, true)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	fingerprint := Fingerprint(tlsConfig)
+	if again, err := ServerTLSConfig(certFile, keyFile, true); err != nil || Fingerprint(again) != fingerprint {
+		t.Fatalf("expected the certificate to be reused, got %q, %v", Fingerprint(again), err)
+	}
+
+	config := DefaultServerConfig()
+	config.TLS = tlsConfig
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	pinned, err := ClientTLSConfig("", strings.ToLower(strings.ReplaceAll(fingerprint, ":", "")))
+	if err != nil {
+		t.Fatalf("failed to pin fingerprint: %v", err)
+	}
+	joined := make(chan int, 1)
+	client := NewClient(addr, "Client")
+	client.SetTLS(pinned)
+	client.SetCallbacks(nil, nil, nil, func(playerID int, _ string) { joined <- playerID })
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Disconnect()
+	if err := client.JoinRoom("", "", ""); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	select {
+	case <-joined:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not get a seat over TLS")
+	}
+
+	wrong, _ := ClientTLSConfig("", strings.Repeat("00", 32))
+	other := NewClient(addr, "Other")
+	other.SetTLS(wrong)
+	if err := other.Connect(); err == nil {
+		other.Disconnect()
+		t.Fatal("expected a client pinning another fingerprint to be refused")
+	}
+
+	// A plain TCP client is hung up on
+	plain := NewClient(addr, "Plain")
+	if err := plain.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer plain.Disconnect()
+	waitFor(t, 2*time.Second, "server to drop a plain client", func() bool { return !plain.IsConnected() })
+}
+
+// TestServerListenAddresses checks that the server listens on a Unix
+// socket and on a listener it is handed, and that clients dial either by
+// URL
+func TestServerListenAddresses(t *testing.T) {
+	for addr, want := range map[string][2]string{
+		"9000":                  {"tcp", ":9000"},
+		"[::1]:9000":            {"tcp", "[::1]:9000"},
+		"tcp6://[::]:9000":      {"tcp6", "[::]:9000"},
+		"unix:///tmp/pong.sock": {"unix", "/tmp/pong.sock"},
+	} {
+		network, address, err := parseAddress(addr)
+		if err != nil || network != want[0] || address != want[1] {
+			t.Errorf("%s: got %s %s, %v; want %s %s", addr, network, address, err, want[0], want[1])
+		}
+	}
+	if _, _, err := parseAddress("udp://localhost:9000"); err == nil {
+		t.Error("expected an unknown network to be refused")
+	}
+
+	join := func(addr string) {
+		t.Helper()
+		joined := make(chan int, 1)
+		client := NewClient(addr, "Client")
+		client.SetCallbacks(nil, nil, nil, func(playerID int, _ string) { joined <- playerID })
+		if err := client.Connect(); err != nil {
+			t.Fatalf("failed to connect to %s: %v", addr, err)
+		}
+		defer client.Disconnect()
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("failed to join: %v", err)
+		}
+		select {
+		case <-joined:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("client on %s did not get a seat", addr)
+		}
+	}
+
+	socket := "unix://" + filepath.Join(t.TempDir(), "pong.sock")
+	server := NewServer(socket)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+	join(socket)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server = NewServer("")
+	if err := server.StartListener(listener); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+	join("tcp://" + listener.Addr().String())
+}
+
+// addrListener is a listener that only has an address
+type addrListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l addrListener) Addr() net.Addr { return l.addr }
+
+// TestServerSideAddress checks where UDP and WebSocket are taken for each
+// kind of address the server can listen on
+func TestServerSideAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr        string // what the server was asked to listen on
+		listening   net.Addr
+		wantNetwork string
+		wantAddress string
+	}{
+		{"9000", &net.TCPAddr{IP: net.IPv6unspecified, Port: 9000}, "udp", ":7000"},
+		{"0.0.0.0:9000", &net.TCPAddr{IP: net.IPv4zero, Port: 9000}, "udp4", ":7000"},
+		{"tcp6://[::]:9000", &net.TCPAddr{IP: net.IPv6unspecified, Port: 9000}, "udp6", ":7000"},
+		{"127.0.0.1:9000", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}, "udp", "127.0.0.1:7000"},
+		{"[fe80::1%eth0]:9000", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 9000}, "udp", "[fe80::1%eth0]:7000"},
+		{"unix:///tmp/pong.sock", &net.UnixAddr{Name: "/tmp/pong.sock", Net: "unix"}, "udp", ":7000"},
+	} {
+		s := &Server{addr: tc.addr, listener: addrListener{addr: tc.listening}}
+		if network, address := s.sideAddress("udp", "7000"); network != tc.wantNetwork || address != tc.wantAddress {
+			t.Errorf("%s: got %s %s, want %s %s", tc.addr, network, address, tc.wantNetwork, tc.wantAddress)
+		}
+	}
+}
+
+// TestServerPlayerNames checks that players go by the names they join
+// with, made unique within the room, that everyone gets a roster, and
+// that names that cannot be shown are refused
+func TestServerPlayerNames(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	connect := func(name string) (*GameClient, chan JoinMessage, chan *ServerError) {
+		t.Helper()
+		joined := make(chan JoinMessage, 1)
+		errs := make(chan *ServerError, 1)
+		client := NewClient(addr, name)
+		client.SetCallbacks(nil, nil, nil, func(playerID int, playerName string) {
+			joined <- JoinMessage{PlayerID: playerID, PlayerName: playerName}
+		})
+		client.SetErrorCallback(func(err *ServerError) { errs <- err })
+		if err := client.Connect(); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		t.Cleanup(client.Disconnect)
+		return client, joined, errs
+	}
+	expectJoin := func(joined chan JoinMessage, playerID int, name string) {
+		t.Helper()
+		select {
+		case join := <-joined:
+			if join.PlayerID != playerID || join.PlayerName != name {
+				t.Fatalf("expected to join as %q (player %d), got %q (player %d)",
+					name, playerID, join.PlayerName, join.PlayerID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q did not join", name)
+		}
+	}
+
+	first, joined, _ := connect("  Ada ")
+	first.JoinRoom("", "", "")
+	expectJoin(joined, 1, "Ada")
+	second, joined, _ := connect("ada")
+	second.JoinRoom("", "", "")
+	expectJoin(joined, 2, "ada 2")
+	watcher, joined, _ := connect("")
+	watcher.Spectate("", "", "")
+	expectJoin(joined, 0, "Spectator")
+
+	want := []RosterEntry{
+		{PlayerID: 1, Name: "Ada", Role: RolePlayer},
+		{PlayerID: 2, Name: "ada 2", Role: RolePlayer},
+		{Name: "Spectator", Role: RoleSpectator},
+	}
+	waitFor(t, time.Second, "everyone to get the full roster", func() bool {
+		for _, client := range []*GameClient{first, second, watcher} {
+			if fmt.Sprint(client.GetRoster()) != fmt.Sprint(want) {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, name := range []string{"Ada\x00", strings.Repeat("x", maxPlayerNameLength+1)} {
+		client, _, errs := connect(name)
+		client.JoinRoom("", "", "")
+		select {
+		case err := <-errs:
+			if err.Code != ErrorInvalidName {
+				t.Fatalf("expected %q to be refused as %s, got %v", name, ErrorInvalidName, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %q to be refused", name)
+		}
+	}
+}
+
+// TestServerHandshake checks version negotiation, rejection of versions the
+// server cannot speak, and that clients without a hello still get a seat
+func TestServerHandshake(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+
+	exchange := func(msg interface{}) map[string]interface{} {
+		t.Helper()
+		return rawReader(t, dialRaw(t, server.Addr().String(), msg))("")
+	}
+
+	future := CreateHelloMessage("future", RolePlayer, []string{FeatureEncodingJSON, "compression:zstd"})
+	future.Version = ProtocolVersion + 5
+	reply := exchange(future)
+	if reply["type"] != string(MessageTypeWelcome) || reply["version"] != float64(ProtocolVersion) {
+		t.Fatalf("expected welcome at version %d, got %v", ProtocolVersion, reply)
+	}
+	if features := reply["features"].([]interface{}); len(features) != 1 || features[0] != FeatureEncodingJSON {
+		t.Fatalf("expected only %s to be agreed, got %v", FeatureEncodingJSON, features)
+	}
+
+	ancient := CreateHelloMessage("ancient", RolePlayer, nil)
+	ancient.Version = 0
+	if reply := exchange(ancient); reply["type"] != string(MessageTypeError) || reply["code"] != ErrorVersionMismatch || reply["fatal"] != true {
+		t.Fatalf("expected fatal %s error, got %v", ErrorVersionMismatch, reply)
+	}
+
+	if reply := exchange(CreateJoinRoomMessage("", "", "")); reply["type"] != string(MessageTypeJoin) {
+		t.Fatalf("expected a client without hello to be seated, got %v", reply)
+	}
+}
+
+// TestServerProtocolV1 seats a client that never sends a hello opposite
+// one that does, and checks that it plays with plain JSON snapshots
+func TestServerProtocolV1(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	opponent := NewClient(addr, "Opponent")
+	if err := opponent.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer opponent.Disconnect()
+	opponent.JoinRoom("", "", "")
+
+	read := rawReader(t, dialRaw(t, addr, CreateJoinRoomMessage("", "", "")))
+	seen := map[interface{}]int{}
+	for seen[string(MessageTypeState)] < 3 {
+		seen[read("")["type"]]++
+	}
+	if seen[string(MessageTypeJoin)] != 1 || seen[string(MessageTypeStart)] != 1 {
+		t.Fatalf("expected the version 1 client to be seated and the game to start, got %v", seen)
+	}
+	if seen[string(MessageTypeWelcome)] != 0 || seen[string(MessageTypeDelta)] != 0 {
+		t.Fatalf("expected no handshake or deltas for a version 1 client, got %v", seen)
+	}
+}
+
+// TestServerMessageSizeLimit checks that a message longer than a scanner
+// line is read, and that one over the configured limit gets a fatal error
+// before the connection is closed
+func TestServerMessageSizeLimit(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxMessageSize = 128 * 1024
+	server := startTestServer(t, config)
+
+	conn := dialRaw(t, server.Addr().String(), rawHello(FeatureEncodingJSON))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	reply := func() map[string]interface{} {
+		t.Helper()
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("no reply: %v", err)
+		}
+		var msg map[string]interface{}
+		if err := DecodeMessage(line, &msg); err != nil {
+			t.Fatalf("bad reply: %v", err)
+		}
+		return msg
+	}
+
+	if msg := reply(); msg["type"] != string(MessageTypeWelcome) {
+		t.Fatalf("expected a welcome, got %v", msg)
+	}
+
+	padded := func(size int) []byte {
+		return []byte(`{"type":"list_rooms","padding":"` + strings.Repeat("x", size) + "\"}\n")
+	}
+	conn.Write(padded(100 * 1024))
+	if msg := reply(); msg["type"] != string(MessageTypeRoomList) {
+		t.Fatalf("expected a room list, got %v", msg)
+	}
+
+	conn.Write(padded(200 * 1024))
+	if msg := reply(); msg["type"] != string(MessageTypeError) || msg["code"] != ErrorMessageTooLarge || msg["fatal"] != true {
+		t.Fatalf("expected fatal %s error, got %v", ErrorMessageTooLarge, msg)
+	}
+	if _, err := reader.ReadBytes('\n'); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+// TestServerMixedEncodings seats a client using binary frames opposite
+// one that keeps to JSON and checks that both receive state
+func TestServerMixedEncodings(t *testing.T) {
+	server := startTestServer(t, DefaultServerConfig())
+	addr := server.Addr().String()
+
+	var states [2]atomic.Int64
+	for i := range states {
+		joined := make(chan int, 1)
+		client := NewClient(addr, fmt.Sprintf("Client %d", i))
+		client.SetBinaryEncoding(i == 0)
+		client.SetCallbacks(
+			func(game.GameState) { states[i].Add(1) },
+			nil,
+			nil,
+			func(playerID int, _ string) { joined <- playerID },
+		)
+		if err := client.Connect(); err != nil {
+			t.Fatalf("client %d failed to connect: %v", i, err)
+		}
+		defer client.Disconnect()
+		waitFor(t, time.Second, "welcome", func() bool { return client.GetProtocolVersion() != 0 })
+		if binary := client.HasFeature(FeatureEncodingBinary); binary != (i == 0) {
+			t.Fatalf("client %d: binary encoding agreed = %v", i, binary)
+		}
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("client %d failed to join: %v", i, err)
+		}
+		<-joined
+	}
+
+	waitFor(t, 2*time.Second, "state on both encodings", func() bool {
+		return states[0].Load() > 10 && states[1].Load() > 10
+	})
+}
+
+// TestServerDeltaSnapshots checks that a player who acknowledges a
+// snapshot is sent deltas against it, and a keyframe when asking for one
+func TestServerDeltaSnapshots(t *testing.T) {
+	// Only send keyframes when asked to
+	config := DefaultServerConfig()
+	config.KeyframeInterval = time.Hour
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	opponent := NewClient(addr, "Opponent")
+	if err := opponent.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer opponent.Disconnect()
+	opponent.JoinRoom("", "", "")
+
+	conn := dialRaw(t, addr,
+		CreateHelloMessage("Delta", RolePlayer, []string{FeatureEncodingJSON, FeatureDeltaSnapshots}),
+		CreateJoinRoomMessage("", "", ""))
+	send := func(msg interface{}) {
+		data, _ := EncodeMessage(msg)
+		conn.Write(append(data, '\n'))
+	}
+	next := rawReader(t, conn)
+
+	keyframe := next(MessageTypeState)
+	tick := uint32(keyframe["tick"].(float64))
+
+	send(CreateAckMessage(tick))
+	if delta := next(MessageTypeDelta); uint32(delta["base"].(float64)) != tick {
+		t.Fatalf("expected a delta against tick %d, got %v", tick, delta)
+	}
+
+	send(CreateKeyframeRequestMessage())
+	next(MessageTypeState)
+}
+
+// TestServerKeyframesOnly checks that a keyframe interval of zero or less
+// has every snapshot sent full, even to a client that acks them
+func TestServerKeyframesOnly(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		config := DefaultServerConfig()
+		config.KeyframeInterval = interval
+		server := startTestServer(t, config)
+		addr := server.Addr().String()
+
+		dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", ""))
+		conn := dialRaw(t, addr,
+			CreateHelloMessage("Delta", RolePlayer, []string{FeatureEncodingJSON, FeatureDeltaSnapshots}),
+			CreateJoinRoomMessage("", "", ""))
+		read := rawReader(t, conn)
+		read(MessageTypeStart)
+		for i := 0; i < 10; i++ {
+			msg := read("")
+			if msg["type"] == string(MessageTypeDelta) {
+				t.Fatalf("keyframe interval %v: expected only full snapshots, got %v", interval, msg)
+			}
+			if msg["type"] == string(MessageTypeState) {
+				ack, _ := EncodeMessage(CreateAckMessage(uint32(msg["tick"].(float64))))
+				conn.Write(append(ack, '\n'))
+			}
+		}
+	}
+}
+
+// TestServerSendRate checks that a room simulating faster than it sends
+// stamps each snapshot with its tick, so clients can tell how far apart
+// they are
+func TestServerSendRate(t *testing.T) {
+	config := DefaultServerConfig()
+	config.TickRate = 120
+	config.SendRate = 30
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	opponent := NewClient(addr, "Opponent")
+	if err := opponent.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer opponent.Disconnect()
+	opponent.JoinRoom("", "", "")
+
+	read := rawReader(t, dialRaw(t, addr, rawHello(FeatureEncodingJSON), CreateJoinRoomMessage("", "", "")))
+	var ticks []uint32
+	var start time.Time
+	for len(ticks) < 10 {
+		switch msg := read(""); msg["type"] {
+		case string(MessageTypeJoin):
+			if msg["tickRate"] != float64(120) {
+				t.Fatalf("expected the join to give the tick rate, got %v", msg)
+			}
+		case string(MessageTypeState):
+			if len(ticks) == 0 {
+				start = time.Now()
+			}
+			ticks = append(ticks, uint32(msg["tick"].(float64)))
+		}
+	}
+	for i := 1; i < len(ticks); i++ {
+		if ticks[i]-ticks[i-1] != 4 {
+			t.Fatalf("expected a snapshot every 4 ticks, got ticks %v", ticks)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("9 snapshots at 30/s came in %v", elapsed)
+	}
+}
+
+// TestServerQueueSizeDefault checks that a queue size of zero or less
+// falls back to the default rather than leaving clients no room at all
+func TestServerQueueSizeDefault(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		config := DefaultServerConfig()
+		config.QueueSize = size
+		server := startTestServer(t, config)
+
+		conn := dialRaw(t, server.Addr().String(), rawHello(FeatureEncodingJSON))
+		if msg := rawReader(t, conn)(""); msg["type"] != string(MessageTypeWelcome) {
+			t.Fatalf("queue size %d: expected a welcome, got %v", size, msg)
+		}
+	}
+}
+
+// TestServerUDPTransport checks that clients asking for UDP get their
+// snapshots that way over loopback, with control messages left on TCP
+func TestServerUDPTransport(t *testing.T) {
+	config := DefaultServerConfig()
+	config.UDPPort = "0"
+	server := startTestServer(t, config)
+	addr := server.Addr().String()
+
+	var states atomic.Int64
+	clients := make([]*GameClient, 2)
+	for i := range clients {
+		joined := make(chan int, 1)
+		client := NewClient(addr, fmt.Sprintf("Client %d", i))
+		client.SetUDP(true)
+		client.SetCallbacks(
+			func(game.GameState) { states.Add(1) },
+			nil,
+			nil,
+			func(playerID int, _ string) { joined <- playerID },
+		)
+		if err := client.Connect(); err != nil {
+			t.Fatalf("client %d failed to connect: %v", i, err)
+		}
+		defer client.Disconnect()
+		waitFor(t, 2*time.Second, "UDP to be bound", client.UsingUDP)
+		if err := client.JoinRoom("", "", ""); err != nil {
+			t.Fatalf("client %d failed to join over TCP: %v", i, err)
+		}
+		<-joined
+		clients[i] = client
+	}
+
+	server.udpMu.Lock()
+	bound := len(server.udpClients)
+	server.udpMu.Unlock()
+	if bound != 2 {
+		t.Fatalf("expected both clients bound over UDP, got %d", bound)
+	}
+
+	waitFor(t, 2*time.Second, "snapshots over UDP", func() bool { return states.Load() > 20 })
+	for i := 0; i < 10; i++ {
+		clients[0].SendInput(1, 0)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if rooms := server.ListRooms(); len(rooms) != 1 || rooms[0].Players != 2 || !rooms[0].Started {
+		t.Fatalf("expected one started room with both players, got %+v", rooms)
+	}
+}
+
+// TestServerUDPBinding checks that the server takes datagrams on the
+// interface it listens on, and binds a token only from the host it was
+// given to
+func TestServerUDPBinding(t *testing.T) {
+	config := DefaultServerConfig()
+	config.UDPPort = "0"
+	server := NewServerWithConfig("127.0.0.1:0", config)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	udpAddr := server.UDPAddr().(*net.UDPAddr)
+	if !udpAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected UDP on 127.0.0.1 like the listener, got %s", udpAddr)
+	}
+
+	conn := dialRaw(t, server.Addr().String(), rawHello(FeatureEncodingJSON, FeatureTransportUDP))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("no welcome: %v", err)
+	}
+	var welcome WelcomeMessage
+	if err := DecodeMessage(line, &welcome); err != nil || welcome.UDPToken == "" {
+		t.Fatalf("expected a UDP token in the welcome, got %s", line)
+	}
+
+	// bind sends the token from a host and reports whether it was echoed
+	bind := func(host string) bool {
+		t.Helper()
+		udp, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)}, udpAddr)
+		if err != nil {
+			t.Skipf("cannot send from %s: %v", host, err)
+		}
+		defer udp.Close()
+		frame, _ := EncodeBinary(CreateUDPHelloMessage(welcome.UDPToken))
+		udp.Write(frame)
+		udp.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, err = udp.Read(make([]byte, maxDatagramSize))
+		return err == nil
+	}
+	if bind("127.0.0.2") {
+		t.Fatal("expected a token replayed from another host to be ignored")
+	}
+	if !bind("127.0.0.1") {
+		t.Fatal("expected the token to bind from the client's host")
+	}
+
+	// A client on a Unix socket has no host to bind from, so is not
+	// offered UDP
+	socket := filepath.Join(t.TempDir(), "pong.sock")
+	server = NewServerWithConfig("unix://"+socket, config)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	local, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer local.Close()
+	hello, _ := EncodeMessage(rawHello(FeatureEncodingJSON, FeatureTransportUDP))
+	local.Write(append(hello, '\n'))
+	reply := rawReader(t, local)(MessageTypeWelcome)
+	if features := fmt.Sprint(reply["features"]); strings.Contains(features, FeatureTransportUDP) || reply["udpToken"] != nil {
+		t.Fatalf("expected no UDP offered over a Unix socket, got %v", reply)
+	}
+}
+
+// TestClientUDPHelloEcho checks that a client only starts sending over UDP
+// once the server echoes its own UDP hello, not on any datagram that looks
+// like one
+func TestClientUDPHelloEcho(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer peer.Close()
+	conn, err := net.Dial("udp", peer.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	client := NewClient("127.0.0.1:0", "Client")
+	client.udpConn = conn
+	bound := make(chan struct{})
+	go client.readDatagrams(conn, "ours", bound)
+
+	// The peer learns where the client is from its first datagram
+	conn.Write([]byte("hello"))
+	_, addr, err := peer.ReadFromUDP(make([]byte, maxDatagramSize))
+	if err != nil {
+		t.Fatalf("no datagram from the client: %v", err)
+	}
+
+	for _, msg := range []interface{}{
+		CreateUDPHelloMessage("theirs"),
+		CreateRoomCreatedMessage("1", "Room 1", "ours"),
+	} {
+		frame, _ := EncodeBinary(msg)
+		peer.WriteToUDP(frame, addr)
+	}
+	select {
+	case <-bound:
+		t.Fatal("expected only an echo of our own UDP hello to bind")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	frame, _ := EncodeBinary(CreateUDPHelloMessage("ours"))
+	peer.WriteToUDP(frame, addr)
+	select {
+	case <-bound:
+	case <-time.After(time.Second):
+		t.Fatal("expected the echo of our UDP hello to bind")
+	}
+}
+
+// wsTestClient is just enough of a WebSocket client to test the server's
+// side of the protocol with
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, addr string) *wsTestClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /play HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", addr, key)
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	r := bufio.NewReader(conn)
+	status, _ := r.ReadString('\n')
+	if !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Fatalf("expected the upgrade to be accepted, got %q", status)
+	}
+	accepted := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read handshake: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		// The accept value for this key given in RFC 6455
+		accepted = accepted || line == "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"
+	}
+	if !accepted {
+		t.Fatal("wrong or missing Sec-WebSocket-Accept")
+	}
+	return &wsTestClient{t: t, conn: conn, r: r}
+}
+
+// send sends a message as a masked text message
+func (c *wsTestClient) send(msg interface{}) {
+	data, _ := EncodeMessage(msg)
+	c.sendFrame(true, wsText, data)
+}
+
+// sendFrame sends one masked frame, of up to 64 KiB
+func (c *wsTestClient) sendFrame(fin bool, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	if fin {
+		opcode |= 0x80
+	}
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	if len(payload) >= 126 {
+		frame = []byte{opcode, 0x80 | 126, byte(len(payload) >> 8), byte(len(payload))}
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+// readFrame reads one frame from the server and returns its opcode and
+// payload, failing the test with what was expected if there is none
+func (c *wsTestClient) readFrame(what string) (byte, []byte) {
+	c.t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		c.t.Fatalf("no %s: %v", what, err)
+	}
+	size := int(header[1] & 0x7f)
+	if size == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(c.r, ext)
+		size = int(ext[0])<<8 | int(ext[1])
+	}
+	payload := make([]byte, size)
+	io.ReadFull(c.r, payload)
+	return header[0] & 0x0f, payload
+}
+
+// closeCode reads frames until the server's close frame and returns the
+// code it gave
+func (c *wsTestClient) closeCode() int {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame("close frame")
+		if opcode == wsClose && len(payload) >= 2 {
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+// next reads messages until one of the given type arrives
+func (c *wsTestClient) next(want MessageType) map[string]interface{} {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame(string(want) + " message")
+		if opcode != wsText {
+			continue
+		}
+
+		var msg map[string]interface{}
+		if err := DecodeMessage(payload, &msg); err != nil {
+			c.t.Fatalf("bad message %q: %v", payload, err)
+		}
+		if msg["type"] == string(want) {
+			return msg
+		}
+	}
+}
+
+// TestServerWebSocket seats a WebSocket player opposite a TCP one and
+// checks the game starts for both
+func TestServerWebSocket(t *testing.T) {
+	config := DefaultServerConfig()
+	config.WSPort = "0"
+	server := startTestServer(t, config)
+
+	ws := dialWebSocket(t, server.WSAddr().String())
+	ws.send(CreateHelloMessage("Browser", RolePlayer, []string{FeatureEncodingJSON}))
+	ws.next(MessageTypeWelcome)
+	ws.send(CreateJoinRoomMessage("", "", ""))
+	join := ws.next(MessageTypeJoin)
+
+	started := make(chan struct{}, 1)
+	client := NewClient(server.Addr().String(), "Native")
+	client.SetCallbacks(nil, func(game.GameSettings) { started <- struct{}{} }, nil, nil)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Disconnect()
+	if err := client.JoinRoom(join["roomId"].(string), "", ""); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+
+	ws.next(MessageTypeStart)
+	ws.next(MessageTypeState)
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("game did not start for the TCP player")
+	}
+}
+
+// TestServerWebSocketFrames checks that control frames that are too long or
+// fragmented close the connection as a protocol error, and that a message
+// over the size limit gets the usual error before the connection closes
+func TestServerWebSocketFrames(t *testing.T) {
+	config := DefaultServerConfig()
+	config.WSPort = "0"
+	config.MaxMessageSize = 1024
+	server := startTestServer(t, config)
+	addr := server.WSAddr().String()
+
+	ws := dialWebSocket(t, addr)
+	ws.sendFrame(true, wsPing, make([]byte, 126))
+	if code := ws.closeCode(); code != wsCloseProtocol {
+		t.Fatalf("expected a long ping to close with %d, got %d", wsCloseProtocol, code)
+	}
+
+	ws = dialWebSocket(t, addr)
+	ws.sendFrame(false, wsPing, []byte("ping"))
+	if code := ws.closeCode(); code != wsCloseProtocol {
+		t.Fatalf("expected a fragmented ping to close with %d, got %d", wsCloseProtocol, code)
+	}
+
+	for _, frames := range [][]int{{2000}, {1000, 1000}} {
+		ws = dialWebSocket(t, addr)
+		for i, size := range frames {
+			opcode := byte(wsText)
+			if i > 0 {
+				opcode = wsContinuation
+			}
+			ws.sendFrame(i == len(frames)-1, opcode, bytes.Repeat([]byte("x"), size))
+		}
+		if reply := ws.next(MessageTypeError); reply["code"] != ErrorMessageTooLarge || reply["fatal"] != true {
+			t.Fatalf("frames of %v bytes: expected a fatal %s error, got %v", frames, ErrorMessageTooLarge, reply)
+		}
+		if code := ws.closeCode(); code != wsCloseTooBig {
+			t.Fatalf("frames of %v bytes: expected to close with %d, got %d", frames, wsCloseTooBig, code)
+		}
+	}
+}
+
+// TestServerWebSocketOrigins checks that the WebSocket port is on the
+// interface the server listens on, and that pages from origins that are
+// not allowed are refused
+func TestServerWebSocketOrigins(t *testing.T) {
+	config := DefaultServerConfig()
+	config.WSPort = "0"
+	config.AllowedOrigins = []string{"https://pong.example.com"}
+	server := NewServerWithConfig("127.0.0.1:0", config)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+	addr := server.WSAddr().String()
+	if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.1" {
+		t.Fatalf("expected WebSocket on 127.0.0.1 like the listener, got %s", addr)
+	}
+
+	for origin, want := range map[string]string{
+		"":                         "101",
+		"https://pong.example.com": "101",
+		"http://" + addr:           "101",
+		"https://evil.example.com": "403",
+		"http://localhost:1":       "403",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		header := ""
+		if origin != "" {
+			header = "Origin: " + origin + "\r\n"
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n%s\r\n", addr, header)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		status, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if !strings.HasPrefix(status, "HTTP/1.1 "+want) {
+			t.Errorf("origin %q: expected %s, got %q", origin, want, status)
+		}
+	}
+}
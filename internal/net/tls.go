@@ -0,0 +1,173 @@
+package net
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Connections can be encrypted with TLS. The server takes a certificate
+// and key, and can make itself a self-signed pair on first start. Clients
+// check the server's certificate against the system's roots or a CA file,
+// or, to do without a CA, pin the certificate's SHA-256 fingerprint. UDP
+// datagrams are not encrypted.
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// ServerTLSConfig loads a certificate and key from PEM files. If
+// selfSigned is set and neither file exists, it first generates a
+// self-signed certificate and key and writes them there, so later starts
+// reuse them and clients can keep pinning the same fingerprint.
+func ServerTLSConfig(certFile, keyFile string, selfSigned bool) (*tls.Config, error) {
+	if selfSigned && !fileExists(certFile) && !fileExists(keyFile) {
+		if err := writeSelfSigned(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("failed to generate certificate: %v", err)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLSConfig returns the TLS configuration for connecting to a
+// server. With a fingerprint, the server's certificate must have that
+// SHA-256 fingerprint and nothing else about it is checked. Otherwise it
+// must be signed by the CA in caFile, or by one the system trusts if
+// caFile is empty.
+func ClientTLSConfig(caFile, fingerprint string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if fingerprint != "" {
+		want, err := parseFingerprint(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// Verification is done by hand, against the pinned fingerprint
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			got := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if string(got[:]) != string(want) {
+				return fmt.Errorf("server certificate has fingerprint %s, expected %s",
+					formatFingerprint(got[:]), formatFingerprint(want))
+			}
+			return nil
+		}
+		return config, nil
+	}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the first certificate in
+// a TLS configuration, in the form clients pin it, or "" if it has none
+func Fingerprint(config *tls.Config) string {
+	if config == nil || len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(config.Certificates[0].Certificate[0])
+	return formatFingerprint(sum[:])
+}
+
+// formatFingerprint writes a fingerprint as colon-separated hex pairs, as
+// openssl x509 -fingerprint does
+func formatFingerprint(sum []byte) string {
+	pairs := make([]string, len(sum))
+	for i, b := range sum {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
+
+// parseFingerprint reads a SHA-256 fingerprint in hex, with or without
+// colons
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	sum, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("fingerprint %q is not a SHA-256 fingerprint in hex", fingerprint)
+	}
+	return sum, nil
+}
+
+// writeSelfSigned generates a self-signed certificate for this host and
+// writes it and its key as PEM. The key file is only readable by us.
+func writeSelfSigned(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[len(hosts)-1]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              hosts,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// fileExists reports whether a file exists
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
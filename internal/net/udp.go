@@ -0,0 +1,330 @@
+package net
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Snapshots, inputs and acks can travel as UDP datagrams instead of over
+// the TCP connection, so that one lost packet does not hold up everything
+// sent after it. Each datagram holds exactly one binary frame. Nothing is
+// resent: snapshots and inputs carry sequence numbers, and the receiver
+// drops any older than the newest it has seen. Everything else, from
+// joins to the end of the game, stays on the reliable TCP connection.
+
+// maxDatagramSize is the largest frame sent as a datagram, small enough
+// not to be fragmented on a typical path. Bigger frames go over TCP.
+const maxDatagramSize = 1200
+
+// Binding a client's UDP address: the client sends its token until the
+// server echoes it back, or gives up and stays on TCP
+const (
+	udpHelloAttempts = 10
+	udpHelloInterval = 250 * time.Millisecond
+)
+
+// decodeDatagram checks that a datagram holds one whole frame and decodes
+// it like DecodeBinary
+func decodeDatagram(datagram []byte) (interface{}, []byte, error) {
+	if len(datagram) < frameHeaderSize {
+		return nil, nil, fmt.Errorf("datagram of %d bytes is too short", len(datagram))
+	}
+	size := binary.BigEndian.Uint32(datagram)
+	if int(size) != len(datagram)-frameHeaderSize {
+		return nil, nil, fmt.Errorf("datagram of %d bytes holds a frame of %d", len(datagram), size)
+	}
+	return DecodeBinary(datagram[frameHeaderSize:])
+}
+
+// listenUDP opens the server's UDP socket, on the interface the server
+// listens on. Start reads from it once the server is running.
+func (s *Server) listenUDP() error {
+	network, address := s.sideAddress("udp", s.config.UDPPort)
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return err
+	}
+	s.udp, err = net.ListenUDP(network, addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Taking UDP datagrams on %s", s.udp.LocalAddr())
+	return nil
+}
+
+// UDPAddr returns the address the server takes datagrams on, or nil if
+// UDP is disabled
+func (s *Server) UDPAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// offerUDP gives a client a token to bind its UDP address with, and puts
+// where to send it in the welcome
+func (s *Server) offerUDP(client *Client, welcome *WelcomeMessage) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("failed to generate UDP token: %v", err)
+	}
+	client.udp = s.udp
+	client.udpToken = hex.EncodeToString(b)
+
+	s.udpMu.Lock()
+	s.udpTokens[client.udpToken] = client
+	s.udpMu.Unlock()
+
+	welcome.UDPPort = s.udp.LocalAddr().(*net.UDPAddr).Port
+	welcome.UDPToken = client.udpToken
+	return nil
+}
+
+// forgetUDP drops a disconnected client's token and address
+func (s *Server) forgetUDP(client *Client) {
+	if client.udpToken == "" {
+		return
+	}
+
+	s.udpMu.Lock()
+	delete(s.udpTokens, client.udpToken)
+	if addr := client.udpAddr.Load(); addr != nil {
+		delete(s.udpClients, addr.String())
+	}
+	s.udpMu.Unlock()
+}
+
+// readDatagrams handles datagrams until the UDP socket is closed. Anything
+// that is not a frame from a bound client is dropped.
+func (s *Server) readDatagrams() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !s.running.Load() {
+				return
+			}
+			log.Printf("Error reading datagram: %v", err)
+			continue
+		}
+
+		msg, data, err := decodeDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		if data != nil {
+			s.bindUDP(addr, data)
+			continue
+		}
+
+		s.udpMu.Lock()
+		client := s.udpClients[addr.String()]
+		s.udpMu.Unlock()
+		if client == nil {
+			continue
+		}
+		m := client.joined.Load()
+		if m == nil {
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *InputMessage:
+			m.input(client, *msg)
+		case *AckMessage:
+			m.ack(client, msg.Tick, false)
+		}
+	}
+}
+
+// bindUDP ties the address a UDP hello came from to the client its token
+// was issued to, and echoes the hello so the client knows. The hello has
+// to come from the host the client is connected from, so a token seen on
+// the wire cannot be replayed from elsewhere to take the client's
+// snapshots. It may come again from another port on that host, as it does
+// when a NAT maps the client anew.
+func (s *Server) bindUDP(addr *net.UDPAddr, data []byte) {
+	var msg UDPHelloMessage
+	if err := DecodeMessage(data, &msg); err != nil || msg.Type != MessageTypeUDPHello {
+		return
+	}
+
+	s.udpMu.Lock()
+	client := s.udpTokens[msg.Token]
+	if client != nil && !sameHost(client.conn.RemoteAddr(), addr) {
+		log.Printf("Ignoring UDP hello for %s from %s", client.conn.RemoteAddr(), addr)
+		client = nil
+	}
+	if client != nil {
+		if old := client.udpAddr.Swap(addr); old != nil {
+			delete(s.udpClients, old.String())
+		}
+		s.udpClients[addr.String()] = client
+	}
+	s.udpMu.Unlock()
+	if client == nil {
+		return
+	}
+
+	if frame, err := EncodeBinary(&msg); err == nil {
+		s.udp.WriteToUDP(frame, addr)
+	}
+}
+
+// sameHost reports whether a datagram came from the host at the other end
+// of a connection
+func sameHost(peer net.Addr, addr *net.UDPAddr) bool {
+	tcp, ok := peer.(*net.TCPAddr)
+	return ok && tcp.IP.Equal(addr.IP)
+}
+
+// sendDatagram sends a message to the client over UDP, and reports
+// whether it did. It does not if the client has not bound an address or
+// the message is too big for one datagram.
+func (c *Client) sendDatagram(msg interface{}) bool {
+	addr := c.udpAddr.Load()
+	if addr == nil {
+		return false
+	}
+
+	frame, err := EncodeBinary(msg)
+	if err != nil || len(frame) > maxDatagramSize {
+		return false
+	}
+	if _, err := c.udp.WriteToUDP(frame, addr); err != nil {
+		log.Printf("Error sending datagram to %s: %v", addr, err)
+		return true
+	}
+	c.snapshotsSent.Add(1)
+	return true
+}
+
+// dialUDP opens a UDP socket to the port the server named in its welcome
+// and binds it with the token, then reads datagrams from it. If the
+// server never answers we stay on TCP.
+func (c *GameClient) dialUDP(port int, token string) {
+	network, address, err := parseAddress(c.serverAddr)
+	if err == nil && network == "unix" {
+		err = fmt.Errorf("no UDP to a server on a Unix socket")
+	}
+	if err != nil {
+		log.Printf("Staying on TCP: %v", err)
+		return
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		log.Printf("Staying on TCP: %v", err)
+		return
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		log.Printf("Staying on TCP: %v", err)
+		return
+	}
+
+	// Disconnect may have been called while we were dialing
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		conn.Close()
+		return
+	}
+	c.writeMu.Lock()
+	c.closeUDP()
+	c.udpConn = conn
+	c.writeMu.Unlock()
+	c.mu.RUnlock()
+
+	hello, err := EncodeBinary(CreateUDPHelloMessage(token))
+	if err != nil {
+		log.Printf("Staying on TCP: %v", err)
+		return
+	}
+	bound := make(chan struct{})
+	c.goTracked(func() { c.readDatagrams(conn, token, bound) })
+
+	for attempt := 0; attempt < udpHelloAttempts; attempt++ {
+		if _, err := conn.Write(hello); err != nil {
+			log.Printf("Error sending UDP hello: %v", err)
+		}
+		select {
+		case <-bound:
+			log.Printf("Using UDP for snapshots and inputs")
+			return
+		case <-c.stop:
+			return
+		case <-time.After(udpHelloInterval):
+		}
+	}
+	log.Printf("No answer over UDP, staying on TCP")
+}
+
+// closeUDP closes the UDP socket, if any, and goes back to sending
+// everything over TCP. The caller holds writeMu.
+func (c *GameClient) closeUDP() {
+	if c.udpConn != nil {
+		c.udpConn.Close()
+		c.udpConn = nil
+	}
+	c.sendUDP = false
+}
+
+// readDatagrams handles datagrams from the server until the socket is
+// closed. bound is closed when the server echoes our UDP hello with our
+// token, after which inputs and acks are sent over UDP too.
+func (c *GameClient) readDatagrams(conn net.Conn, token string, bound chan struct{}) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// A datagram that found nobody listening can come back as an
+			// error, which says nothing about the ones to come
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return
+		}
+
+		msg, data, err := decodeDatagram(buf[:n])
+		if err != nil {
+			log.Printf("Dropping datagram: %v", err)
+			continue
+		}
+		if data != nil {
+			var hello UDPHelloMessage
+			if err := DecodeMessage(data, &hello); err != nil ||
+				hello.Type != MessageTypeUDPHello || hello.Token != token {
+				log.Printf("Dropping datagram that is not our UDP hello")
+				continue
+			}
+			c.writeMu.Lock()
+			if c.udpConn == conn && !c.sendUDP {
+				c.sendUDP = true
+				close(bound)
+			}
+			c.writeMu.Unlock()
+			continue
+		}
+
+		// The last snapshots of a game can arrive after the end message,
+		// which came over TCP, and are dropped rather than shown
+		c.recvMu.Lock()
+		if !c.ended {
+			switch m := msg.(type) {
+			case *StateMessage:
+				c.processKeyframe(m)
+			case *DeltaMessage:
+				c.processDelta(m)
+			}
+		}
+		c.recvMu.Unlock()
+	}
+}
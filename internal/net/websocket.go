@@ -0,0 +1,393 @@
+package net
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Browsers connect over WebSocket (RFC 6455) and speak the same protocol
+// as TCP clients: each WebSocket message carries one protocol message,
+// JSON in a text message or a binary frame in a binary message. A
+// WebSocket connection is wrapped up as a net.Conn that reads and writes
+// the same byte stream a TCP connection would, so the rest of the server
+// cannot tell the two apart and players on either can share a room.
+
+// websocketGUID is appended to the client's key to make the accept key
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsCloseTimeout is how long sending a close frame may take
+const wsCloseTimeout = time.Second
+
+// WebSocket close codes
+const (
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseTooBig   = 1009
+)
+
+// listenWebSocket opens the WebSocket listener, on the interface the
+// server listens on. Start serves it once the server is running.
+func (s *Server) listenWebSocket() error {
+	listener, err := net.Listen(s.sideAddress("tcp", s.config.WSPort))
+	if err != nil {
+		return err
+	}
+	if s.config.TLS != nil {
+		listener = tls.NewListener(listener, s.config.TLS)
+	}
+	s.wsListener = listener
+	s.wsServer = &http.Server{Handler: http.HandlerFunc(s.upgradeWebSocket)}
+	log.Printf("Taking WebSocket connections on %s", listener.Addr())
+	return nil
+}
+
+// WSAddr returns the address the server takes WebSocket connections on,
+// or nil if WebSocket is disabled
+func (s *Server) WSAddr() net.Addr {
+	if s.wsListener == nil {
+		return nil
+	}
+	return s.wsListener.Addr()
+}
+
+// upgradeWebSocket completes the opening handshake and then handles the
+// connection like any other client
+func (s *Server) upgradeWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !s.originAllowed(r) {
+		log.Printf("Refusing WebSocket connection from %s: origin %q is not allowed",
+			r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot take over the connection", http.StatusInternalServerError)
+		return
+	}
+	// The HTTP server forgets a connection once it is taken over, so count
+	// it here for Stop to wait for
+	if !s.track() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.wg.Done()
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error taking over WebSocket connection: %v", err)
+		return
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		log.Printf("Error completing WebSocket handshake: %v", err)
+		conn.Close()
+		return
+	}
+
+	s.handleClient(newWSConn(conn, rw.Reader, s.config.MaxMessageSize))
+}
+
+// originAllowed reports whether the page a WebSocket request comes from
+// may connect; see ServerConfig.AllowedOrigins
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for a key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header lists token,
+// ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a server-side WebSocket connection that reads and writes the
+// protocol's byte stream. Reading turns each text message into a line of
+// JSON and passes binary messages through. Each Write must hold exactly
+// one protocol message, which is how the client writer uses it, and is
+// sent as a text message if it is JSON or a binary message if not.
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader
+	pending []byte // what is left of the message being read
+	maxSize int    // the largest message accepted
+
+	// closeCode is sent when the connection is closed, once the server has
+	// told the client why. Zero means wsCloseNormal.
+	closeCode atomic.Uint32
+
+	writeMu   sync.Mutex // Writes come from the writer and from replies to pings
+	closeOnce sync.Once  // Only one close frame is sent
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, maxSize int) *wsConn {
+	return &wsConn{Conn: conn, r: r, maxSize: messageSizeLimit(maxSize)}
+}
+
+// Read reads from the current message, reading the next one once it is
+// used up
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = message
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads frames until it has a whole data message, answering
+// pings and closes along the way
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	var opcode byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.sendClose(payload)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return nil, c.fail(wsCloseProtocol, "new message before the last one finished")
+			}
+			opcode = op
+		case wsContinuation:
+			if opcode == 0 {
+				return nil, c.fail(wsCloseProtocol, "continuation with no message")
+			}
+		default:
+			return nil, c.fail(wsCloseProtocol, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if len(message)+len(payload) > c.maxSize {
+			return nil, c.tooBig("message")
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		if opcode == wsText {
+			message = append(message, '\n')
+		}
+		if len(message) > 0 {
+			return message, nil
+		}
+		opcode = 0
+	}
+}
+
+// readFrame reads and unmasks one frame
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		err = c.fail(wsCloseProtocol, "reserved bits set")
+		return
+	}
+	if header[1]&0x80 == 0 {
+		err = c.fail(wsCloseProtocol, "client frames must be masked")
+		return
+	}
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	// Control frames stand alone and are small, so they can come between
+	// the frames of a message
+	if opcode&0x08 != 0 && !fin {
+		err = c.fail(wsCloseProtocol, "fragmented control frame")
+		return
+	}
+	if opcode&0x08 != 0 && size > 125 {
+		err = c.fail(wsCloseProtocol, "control frame longer than 125 bytes")
+		return
+	}
+	if size > uint64(c.maxSize) {
+		err = c.tooBig("frame")
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Write sends one protocol message as one WebSocket message
+func (c *wsConn) Write(p []byte) (int, error) {
+	opcode := byte(wsBinary)
+	message := p
+	if len(p) > 0 && p[0] == '{' {
+		opcode = wsText
+		message = trimNewline(p)
+	}
+	if err := c.writeFrame(opcode, message); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes an unmasked frame, as servers do
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// fail closes the connection with a close code after a protocol error,
+// and returns the error
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.closeWith(code)
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+// tooBig returns an error wrapping ErrMessageTooLarge, so the server
+// sends the client a message_too_large error before hanging up, and has
+// the connection closed with wsCloseTooBig when it does
+func (c *wsConn) tooBig(what string) error {
+	c.closeCode.Store(wsCloseTooBig)
+	return fmt.Errorf("%w: %s longer than %d bytes", ErrMessageTooLarge, what, c.maxSize)
+}
+
+// Close sends a close frame and closes the connection
+func (c *wsConn) Close() error {
+	code := uint16(c.closeCode.Load())
+	if code == 0 {
+		code = wsCloseNormal
+	}
+	return c.closeWith(code)
+}
+
+// closeWith sends a close frame with the code and closes the connection
+func (c *wsConn) closeWith(code uint16) error {
+	c.sendClose(binary.BigEndian.AppendUint16(nil, code))
+	return c.Conn.Close()
+}
+
+// sendClose sends a close frame unless one was sent already, giving up on
+// it quickly if the peer is not reading
+func (c *wsConn) sendClose(payload []byte) {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		c.writeFrame(wsClose, payload)
+	})
+}
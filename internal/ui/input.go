@@ -16,10 +16,6 @@ type InputHandler struct {
 	keysPressed map[ebiten.Key]bool
 	lastInput   map[ebiten.Key]bool
 
-	// Paddle movement
-	paddle1Y float64
-	paddle2X float64
-
 	// Menu navigation
 	menuOption int
 }
@@ -30,8 +26,6 @@ func NewInputHandler(renderer *Renderer) *InputHandler {
 		renderer:    renderer,
 		keysPressed: make(map[ebiten.Key]bool),
 		lastInput:   make(map[ebiten.Key]bool),
-		paddle1Y:    300,
-		paddle2X:    300,
 		menuOption:  0,
 	}
 }
@@ -50,11 +44,11 @@ func (ih *InputHandler) Update() {
 	}
 
 	// Handle menu input
-	if ih.renderer.showMenu {
+	if ih.renderer.IsMenuShown() {
 		ih.handleMenuInput()
-	} else if ih.renderer.gameStarted && !ih.renderer.gameOver {
+	} else if ih.renderer.IsGameStarted() && !ih.renderer.IsGameOver() {
 		ih.handleGameInput()
-	} else if ih.renderer.gameOver {
+	} else if ih.renderer.IsGameOver() {
 		ih.handleGameOverInput()
 	}
 }
@@ -63,12 +57,12 @@ func (ih *InputHandler) Update() {
 func (ih *InputHandler) handleMenuInput() {
 	// Menu navigation
 	if inpututil.IsKeyJustPressed(ebiten.KeyUp) {
-		ih.menuOption = (ih.menuOption - 1 + len(ih.renderer.menuOptions)) % len(ih.renderer.menuOptions)
+		ih.menuOption = (ih.menuOption - 1 + ih.renderer.MenuOptionCount()) % ih.renderer.MenuOptionCount()
 		ih.renderer.SetMenuOption(ih.menuOption)
 	}
 
 	if inpututil.IsKeyJustPressed(ebiten.KeyDown) {
-		ih.menuOption = (ih.menuOption + 1) % len(ih.renderer.menuOptions)
+		ih.menuOption = (ih.menuOption + 1) % ih.renderer.MenuOptionCount()
 		ih.renderer.SetMenuOption(ih.menuOption)
 	}
 
@@ -80,46 +74,28 @@ func (ih *InputHandler) handleMenuInput() {
 
 // handleGameInput handles input during gameplay
 func (ih *InputHandler) handleGameInput() {
-	var moved bool
+	var vertical, horizontal float64
 
 	// Paddle 1 movement (vertical - left side)
 	if ebiten.IsKeyPressed(ebiten.KeyW) {
-		ih.paddle1Y -= 5
-		moved = true
+		vertical--
 	}
 	if ebiten.IsKeyPressed(ebiten.KeyS) {
-		ih.paddle1Y += 5
-		moved = true
+		vertical++
 	}
 
 	// Paddle 2 movement (horizontal - top side)
 	if ebiten.IsKeyPressed(ebiten.KeyA) {
-		ih.paddle2X -= 5
-		moved = true
+		horizontal--
 	}
 	if ebiten.IsKeyPressed(ebiten.KeyD) {
-		ih.paddle2X += 5
-		moved = true
-	}
-
-	// Constrain paddle positions
-	if ih.paddle1Y < 0 {
-		ih.paddle1Y = 0
-	}
-	if ih.paddle1Y > 500 { // 600 - 100 (paddle height)
-		ih.paddle1Y = 500
-	}
-	if ih.paddle2X < 0 {
-		ih.paddle2X = 0
-	}
-	if ih.paddle2X > 500 { // 600 - 100 (paddle width)
-		ih.paddle2X = 500
+		horizontal++
 	}
 
-	// Send input to server if connected and movement occurred
-	if moved && ih.client != nil {
-		if client, ok := ih.client.(*net.GameClient); ok {
-			client.SendInput(ih.paddle1Y, ih.paddle2X)
+	// Send movement intent to server; it moves and clamps the paddles
+	if (vertical != 0 || horizontal != 0) && ih.client != nil {
+		if client, ok := ih.client.(*net.GameClient); ok && !client.IsSpectator() {
+			client.SendInput(vertical, horizontal)
 		}
 	}
 
@@ -177,17 +153,6 @@ func (ih *InputHandler) handleExit() {
 	// TODO: Exit game
 }
 
-// GetPaddlePositions returns the current paddle positions
-func (ih *InputHandler) GetPaddlePositions() (float64, float64) {
-	return ih.paddle1Y, ih.paddle2X
-}
-
-// SetPaddlePositions sets the paddle positions
-func (ih *InputHandler) SetPaddlePositions(paddle1Y, paddle2X float64) {
-	ih.paddle1Y = paddle1Y
-	ih.paddle2X = paddle2X
-}
-
 // IsKeyJustPressed checks if a key was just pressed
 func (ih *InputHandler) IsKeyJustPressed(key ebiten.Key) bool {
 	return inpututil.IsKeyJustPressed(key)
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"image/color"
 	"network-pong-battle/internal/game"
+	"network-pong-battle/internal/net"
+	"sync"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/text"
@@ -11,15 +14,34 @@ import (
 	"golang.org/x/image/font/basicfont"
 )
 
-// Renderer handles the game graphics rendering
+// errorDisplayTime is how long a non-fatal server error stays on screen
+const errorDisplayTime = 5 * time.Second
+
+// Renderer handles the game graphics rendering. Its setters are called
+// from network callbacks as well as the Ebiten loop, so all fields are
+// guarded by mu.
 type Renderer struct {
+	mu          sync.RWMutex
 	gameState   *game.GameState
+	predicted   []game.Paddle
 	fieldSize   int
 	scale       float64
 	playerID    int
+	spectator   bool
 	gameStarted bool
 	gameOver    bool
 	winner      int
+	endReason   string
+	waitingFor  int // player the game is paused for, or 0
+
+	// Players' names by player ID, from the room's roster
+	names map[int]string
+
+	// The last error the server reported. Fatal errors stay on screen;
+	// others fade after errorDisplayTime.
+	errorText  string
+	errorFatal bool
+	errorAt    time.Time
 
 	// UI state
 	showMenu    bool
@@ -49,6 +71,7 @@ func NewRenderer(fieldSize int) *Renderer {
 			"text":       color.RGBA{255, 255, 255, 255},
 			"score":      color.RGBA{255, 255, 0, 255},
 			"menu":       color.RGBA{100, 150, 255, 255},
+			"error":      color.RGBA{255, 80, 80, 255},
 		},
 	}
 }
@@ -60,6 +83,9 @@ func (r *Renderer) Update() error {
 
 // Draw draws the game graphics
 func (r *Renderer) Draw(screen *ebiten.Image) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	if r.showMenu {
 		r.drawMenu(screen)
 	} else if r.gameOver {
@@ -69,6 +95,8 @@ func (r *Renderer) Draw(screen *ebiten.Image) {
 	} else {
 		r.drawWaiting(screen)
 	}
+
+	r.drawError(screen)
 }
 
 // Layout returns the logical screen size
@@ -78,34 +106,110 @@ func (r *Renderer) Layout(outsideWidth, outsideHeight int) (int, int) {
 
 // SetGameState updates the game state for rendering
 func (r *Renderer) SetGameState(state *game.GameState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if state != nil {
 		r.gameState = state
 	}
 }
 
+// SetPredictedPaddles sets the local player's predicted paddles, which are
+// drawn in place of the server's copy so movement shows up immediately
+func (r *Renderer) SetPredictedPaddles(paddles []game.Paddle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.predicted = paddles
+}
+
 // SetPlayerID sets the current player ID
 func (r *Renderer) SetPlayerID(playerID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.playerID = playerID
 }
 
+// SetSpectator sets whether the client is watching rather than playing
+func (r *Renderer) SetSpectator(spectator bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spectator = spectator
+}
+
+// SetPaused sets whether the game is paused waiting for a player to
+// reconnect, and which player
+func (r *Renderer) SetPaused(paused bool, playerID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waitingFor = 0
+	if paused {
+		r.waitingFor = playerID
+	}
+}
+
+// SetRoster sets who is in the room, so players are shown by name
+func (r *Renderer) SetRoster(roster []net.RosterEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = make(map[int]string)
+	for _, entry := range roster {
+		if entry.Role == net.RolePlayer {
+			r.names[entry.PlayerID] = entry.Name
+		}
+	}
+}
+
+// playerName returns a player's name, or "Player N" if the roster has not
+// named them. Callers hold mu.
+func (r *Renderer) playerName(playerID int) string {
+	if name, ok := r.names[playerID]; ok {
+		return name
+	}
+	return fmt.Sprintf("Player %d", playerID)
+}
+
 // SetGameStarted sets whether the game has started
 func (r *Renderer) SetGameStarted(started bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.gameStarted = started
 }
 
 // SetGameOver sets whether the game is over
 func (r *Renderer) SetGameOver(over bool, winner int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.gameOver = over
 	r.winner = winner
 }
 
+// SetEndReason sets why the game ended, as sent by the server
+func (r *Renderer) SetEndReason(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endReason = reason
+}
+
+// SetError shows an error reported by the server. Fatal errors mean the
+// connection is gone, so they stay on screen.
+func (r *Renderer) SetError(message string, fatal bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errorText = message
+	r.errorFatal = fatal
+	r.errorAt = time.Now()
+}
+
 // SetShowMenu sets whether to show the menu
 func (r *Renderer) SetShowMenu(show bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.showMenu = show
 }
 
 // SetMenuOption sets the selected menu option
 func (r *Renderer) SetMenuOption(option int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if option >= 0 && option < len(r.menuOptions) {
 		r.menuOption = option
 	}
@@ -113,9 +217,37 @@ func (r *Renderer) SetMenuOption(option int) {
 
 // GetMenuOption returns the current menu option
 func (r *Renderer) GetMenuOption() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.menuOption
 }
 
+// IsMenuShown returns whether the menu is showing
+func (r *Renderer) IsMenuShown() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.showMenu
+}
+
+// IsGameStarted returns whether the game has started
+func (r *Renderer) IsGameStarted() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.gameStarted
+}
+
+// IsGameOver returns whether the game is over
+func (r *Renderer) IsGameOver() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.gameOver
+}
+
+// MenuOptionCount returns the number of menu options
+func (r *Renderer) MenuOptionCount() int {
+	return len(r.menuOptions)
+}
+
 // drawMenu draws the main menu
 func (r *Renderer) drawMenu(screen *ebiten.Image) {
 	// Draw background
@@ -167,6 +299,12 @@ func (r *Renderer) drawGame(screen *ebiten.Image) {
 		return
 	}
 	for _, paddle := range r.gameState.Paddles {
+		if paddle.PlayerID == r.playerID && len(r.predicted) > 0 {
+			continue
+		}
+		r.drawPaddle(screen, paddle)
+	}
+	for _, paddle := range r.predicted {
 		r.drawPaddle(screen, paddle)
 	}
 
@@ -180,6 +318,28 @@ func (r *Renderer) drawGame(screen *ebiten.Image) {
 
 	// Draw player info
 	r.drawPlayerInfo(screen)
+
+	if r.waitingFor != 0 {
+		pausedText := fmt.Sprintf("Paused: waiting for %s to reconnect", r.playerName(r.waitingFor))
+		pausedBounds := text.BoundString(r.font, pausedText)
+		pausedX := (r.fieldSize - pausedBounds.Dx()) / 2
+		text.Draw(screen, pausedText, r.font, pausedX, r.fieldSize/2, r.colors["text"])
+	}
+}
+
+// drawError draws the last server error across the top of the screen
+func (r *Renderer) drawError(screen *ebiten.Image) {
+	if r.errorText == "" || (!r.errorFatal && time.Since(r.errorAt) > errorDisplayTime) {
+		return
+	}
+
+	errorText := "Error: " + r.errorText
+	if r.errorFatal {
+		errorText = "Disconnected: " + r.errorText
+	}
+	errorBounds := text.BoundString(r.font, errorText)
+	errorX := (r.fieldSize - errorBounds.Dx()) / 2
+	text.Draw(screen, errorText, r.font, errorX, 50, r.colors["error"])
 }
 
 // drawPaddle draws a paddle
@@ -216,13 +376,17 @@ func (r *Renderer) drawScores(screen *ebiten.Image) {
 	if r.gameState == nil {
 		return
 	}
-	scoreText := fmt.Sprintf("P1: %d  P2: %d", r.gameState.Scores.Player1, r.gameState.Scores.Player2)
+	scoreText := fmt.Sprintf("%s: %d  %s: %d",
+		r.playerName(1), r.gameState.Scores.Player1, r.playerName(2), r.gameState.Scores.Player2)
 	text.Draw(screen, scoreText, r.font, 10, 30, r.colors["text"])
 }
 
 // drawPlayerInfo draws player information
 func (r *Renderer) drawPlayerInfo(screen *ebiten.Image) {
-	playerText := fmt.Sprintf("You are Player %d", r.playerID)
+	playerText := "You are " + r.playerName(r.playerID)
+	if r.spectator {
+		playerText = "Spectating"
+	}
 	text.Draw(screen, playerText, r.font, 10, r.fieldSize-20, r.colors["text"])
 }
 
@@ -236,7 +400,10 @@ func (r *Renderer) drawWaiting(screen *ebiten.Image) {
 	waitingY := r.fieldSize / 2
 	text.Draw(screen, waitingText, r.font, waitingX, waitingY, r.colors["text"])
 
-	playerText := fmt.Sprintf("Connected as Player %d", r.playerID)
+	playerText := "Connected as " + r.playerName(r.playerID)
+	if r.spectator {
+		playerText = "Connected as a spectator"
+	}
 	playerBounds := text.BoundString(r.font, playerText)
 	playerX := (r.fieldSize - playerBounds.Dx()) / 2
 	playerY := r.fieldSize/2 + 20
@@ -255,10 +422,16 @@ func (r *Renderer) drawGameOver(screen *ebiten.Image) {
 
 	// Draw winner
 	var winnerText string
-	if r.winner == 0 {
-		winnerText = "It's a tie!"
+	if r.winner != 0 {
+		winnerText = r.playerName(r.winner) + " wins!"
+	} else if r.endReason == net.EndReasonAbandoned || r.endReason == net.EndReasonAdmin ||
+		r.endReason == net.EndReasonShutdown {
+		winnerText = "No winner"
 	} else {
-		winnerText = fmt.Sprintf("Player %d wins!", r.winner)
+		winnerText = "It's a tie!"
+	}
+	if reason := endReasonText(r.endReason); reason != "" {
+		winnerText += " (" + reason + ")"
 	}
 	winnerBounds := text.BoundString(r.font, winnerText)
 	winnerX := (r.fieldSize - winnerBounds.Dx()) / 2
@@ -268,9 +441,10 @@ func (r *Renderer) drawGameOver(screen *ebiten.Image) {
 	// Draw final scores
 	finalScoreText := ""
 	if r.gameState != nil {
-		finalScoreText = fmt.Sprintf("Final Score - P1: %d, P2: %d", r.gameState.Scores.Player1, r.gameState.Scores.Player2)
+		finalScoreText = fmt.Sprintf("Final Score - %s: %d, %s: %d",
+			r.playerName(1), r.gameState.Scores.Player1, r.playerName(2), r.gameState.Scores.Player2)
 	} else {
-		finalScoreText = "Final Score - P1: ?, P2: ?"
+		finalScoreText = fmt.Sprintf("Final Score - %s: ?, %s: ?", r.playerName(1), r.playerName(2))
 	}
 	scoreBounds := text.BoundString(r.font, finalScoreText)
 	scoreX := (r.fieldSize - scoreBounds.Dx()) / 2
@@ -284,3 +458,23 @@ func (r *Renderer) drawGameOver(screen *ebiten.Image) {
 	menuY := r.fieldSize - 50
 	text.Draw(screen, menuText, r.font, menuX, menuY, r.colors["text"])
 }
+
+// endReasonText describes why a game ended
+func endReasonText(reason string) string {
+	switch reason {
+	case net.EndReasonScore:
+		return "target score reached"
+	case net.EndReasonTime:
+		return "time's up"
+	case net.EndReasonForfeit:
+		return "opponent left"
+	case net.EndReasonAbandoned:
+		return "match abandoned"
+	case net.EndReasonAdmin:
+		return "ended by the server"
+	case net.EndReasonShutdown:
+		return "server shut down"
+	default:
+		return ""
+	}
+}